@@ -1,6 +1,7 @@
 package dnsproxy
 
 import (
+	"container/list"
 	"sync"
 	"time"
 
@@ -8,34 +9,140 @@ import (
 )
 
 // Record is a cached record,
+// Stored is the timestamp when cached,
 // Expired is the expire timestamp,
-// Msg is the dns message.
+// Msg is the dns message with the TTLs when cached,
+// Security is the DNSSEC validation state of Msg.
 type Record struct {
-	Expired time.Time
-	Msg     *dns.Msg
+	Stored   time.Time
+	Expired  time.Time
+	Msg      *dns.Msg
+	Security Security
+
+	key  string        // key in the bounded cache
+	size int           // bytes counted by the bounded cache
+	elem *list.Element // in the lru list of the bounded cache
+	used int32         // accessed since the last eviction check, atomic
+	data interface{}   // parsed from Msg, e.g. the zone cut of a referral
 }
 
-// NewRecord creates a new record from msg.
+// NewRecord creates a new record from msg, which expires with the min
+// TTL of the answers. The negative responses, NXDOMAIN and NODATA, are
+// cached by the SOA in the authority as RFC 2308.
 func NewRecord(msg *dns.Msg) (*Record, bool) {
-	if len(msg.Answer) == 0 {
+	return newRecord(msg, 0, 0)
+}
+
+// newRecord creates a new record from msg, whose TTLs are clamped to
+// [minTTL, maxTTL], no clamp if 0.
+func newRecord(msg *dns.Msg, minTTL, maxTTL time.Duration) (*Record, bool) {
+	negative := msg.Rcode == dns.RcodeNameError || IsNoDataResponse(msg)
+	if len(msg.Answer) == 0 && !negative {
 		return nil, false
 	}
 
-	ttl := time.Duration(msg.Answer[0].Header().Ttl) * time.Second
+	clamp := func(ttl uint32) uint32 {
+		if min := uint32(minTTL / time.Second); ttl < min {
+			ttl = min
+		}
+		if max := uint32(maxTTL / time.Second); max != 0 && ttl > max {
+			ttl = max
+		}
+		return ttl
+	}
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT {
+				h.Ttl = clamp(h.Ttl)
+			}
+		}
+	}
+
+	var ttl uint32
+	for i, rr := range msg.Answer {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	if negative {
+		nttl, ok := negativeTTL(msg)
+		if !ok {
+			return nil, false
+		}
+		if len(msg.Answer) == 0 || nttl < ttl {
+			ttl = clamp(nttl)
+		}
+	}
+	now := time.Now()
 	return &Record{
-		Expired: time.Now().Add(ttl),
+		Stored:  now,
+		Expired: now.Add(time.Duration(ttl) * time.Second),
 		Msg:     msg,
 	}, true
 }
 
+// negativeTTL gets the ttl of the negative response,
+// the min of the SOA's ttl and its MINIMUM field.
+func negativeTTL(msg *dns.Msg) (uint32, bool) {
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return ttl, true
+		}
+	}
+	return 0, false
+}
+
+// Copy copies the message of the record, the TTL of each RR is
+// decremented by the time passed since cached.
+func (r *Record) Copy() *dns.Msg {
+	msg := r.Msg.Copy()
+	age := uint32(time.Since(r.Stored) / time.Second)
+	decayTTLOf(msg.Answer, age)
+	decayTTLOf(msg.Ns, age)
+	decayTTLOf(msg.Extra, age)
+	return msg
+}
+
+func decayTTLOf(rrs []dns.RR, age uint32) {
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT {
+			continue // the TTL of OPT is the extended rcode and flags
+		}
+		if h.Ttl > age {
+			h.Ttl -= age
+		} else {
+			h.Ttl = 0
+		}
+	}
+}
+
 // IsExpired gets whether the record has been expired.
 func (r *Record) IsExpired() bool {
 	return time.Now().After(r.Expired)
 }
 
+// IsNXDomain gets whether the record is a cached NXDOMAIN.
+func (r *Record) IsNXDomain() bool {
+	return r.Msg.Rcode == dns.RcodeNameError
+}
+
+// IsNoData gets whether the record is a cached NODATA.
+func (r *Record) IsNoData() bool {
+	return IsNoDataResponse(r.Msg)
+}
+
 const (
 	maxLen  = 255
 	initCap = 28 * 2 // 26 letters with '.' and '_'
+
+	sweepChunk = 1000 // records checked with the lock held once
+
+	defaultCacheSweepInterval = time.Minute
 )
 
 // Trie is a standard trie tree for dns.
@@ -44,6 +151,29 @@ type Trie struct {
 	IsLeaf bool
 	Next   map[rune]*Trie
 	Data   interface{}
+
+	lru *lru // of the root of a bounded trie
+}
+
+// CacheStats is the statistics of the records in a bounded cache.
+type CacheStats struct {
+	Entries   int
+	Bytes     int    // wire size of the messages and size of the keys
+	Evictions uint64 // records evicted by the limits
+	Expired   uint64 // expired records removed
+}
+
+// lru is the least recently used list of the records in a bounded cache.
+type lru struct {
+	list                 *list.List // of *Record, the most recent first
+	maxEntries, maxBytes int
+	stale                time.Duration // to keep the expired records
+	stats                CacheStats
+}
+
+// outdated gets whether the record is expired out of the stale window.
+func (l *lru) outdated(r *Record) bool {
+	return time.Now().After(r.Expired.Add(l.stale))
 }
 
 // NewTrie creates a new trie.
@@ -53,6 +183,25 @@ func NewTrie() *Trie {
 	}
 }
 
+// NewBoundedTrie creates a trie of the records, which evicts the least
+// recently used records once it has more than maxEntries records or
+// maxBytes bytes, no limit if 0.
+func NewBoundedTrie(maxEntries, maxBytes int) *Trie {
+	t := NewTrie()
+	t.lru = &lru{list: list.New(), maxEntries: maxEntries, maxBytes: maxBytes}
+	return t
+}
+
+// Stats gets the statistics of the bounded trie.
+func (t *Trie) Stats() CacheStats {
+	t.RLock()
+	defer t.RUnlock()
+	if t.lru == nil {
+		return CacheStats{}
+	}
+	return t.lru.stats
+}
+
 // Add adds a record to the trie.
 func (t *Trie) Add(name string, r *Record) {
 	t.Insert(name, r)
@@ -71,12 +220,86 @@ func (t *Trie) Insert(name string, data interface{}) {
 		node = node.Next[c]
 	}
 
+	t.untrack(node.Data)
 	node.IsLeaf = true
 	node.Data = data
+	if r, ok := data.(*Record); ok && t.lru != nil {
+		t.track(name, r)
+	}
 
 	t.Unlock()
 }
 
+// track adds the record to the lru list, and evicts the least recently
+// used records over the limits.
+func (t *Trie) track(name string, r *Record) {
+	l := t.lru
+	r.key, r.size = name, len(name)
+	if r.Msg != nil { // nil if the record only holds the data
+		r.size += r.Msg.Len()
+	}
+	r.elem = l.list.PushFront(r)
+	l.stats.Entries++
+	l.stats.Bytes += r.size
+
+	for l.list.Len() > 0 && (l.maxEntries > 0 && l.stats.Entries > l.maxEntries ||
+		l.maxBytes > 0 && l.stats.Bytes > l.maxBytes) {
+		t.remove(l.list.Back().Value.(*Record).key)
+		l.stats.Evictions++
+	}
+}
+
+func (t *Trie) untrack(data interface{}) {
+	if r, ok := data.(*Record); ok && t.lru != nil && r.elem != nil {
+		t.lru.list.Remove(r.elem)
+		r.elem = nil
+		t.lru.stats.Entries--
+		t.lru.stats.Bytes -= r.size
+	}
+}
+
+// sweep removes the records expired out of the stale window in the lru
+// list by remove from the back, with mu locked for sweepChunk records at
+// most once. The walk restarts from the back if the next record is removed
+// or moved to the front meanwhile, and checks as many records as the list
+// has at the beginning.
+func (l *lru) sweep(mu sync.Locker, remove func(key string), done <-chan struct{}) int {
+	mu.Lock()
+	left := l.list.Len()
+	mu.Unlock()
+
+	var next *list.Element
+	n := 0
+	for left > 0 {
+		select {
+		case <-done:
+			return n
+		default:
+		}
+
+		mu.Lock()
+		for i := 0; i < sweepChunk && left > 0; i++ {
+			if next == nil || next.Value.(*Record).elem != next { // removed
+				next = l.list.Back()
+			}
+			if next == nil { // empty
+				left = 0
+				break
+			}
+			r := next.Value.(*Record)
+			next = next.Prev()
+			left--
+			if l.outdated(r) {
+				remove(r.key)
+				l.stats.Expired++
+				n++
+			}
+		}
+		mu.Unlock()
+	}
+	return n
+}
+
 // Delete deletes the data whose key is name.
 func (t *Trie) Delete(name string) {
 	t.Lock()
@@ -84,20 +307,31 @@ func (t *Trie) Delete(name string) {
 	t.Unlock()
 }
 
+// remove removes the data whose key is name,
+// and prunes the empty branch.
 func (t *Trie) remove(name string) {
-	word, node := reverseString(name), t
-
-	found := true // not have Data which you want to delete
+	word := []rune(reverseString(name))
+	path := make([]*Trie, 0, len(word)+1)
+	node := t
+	path = append(path, node)
 	for _, c := range word {
-		if node.Next[c] == nil { // not found
-			found = false
-			break
+		if node = node.Next[c]; node == nil { // not found
+			return
 		}
-		node = node.Next[c]
+		path = append(path, node)
+	}
+	if !node.IsLeaf {
+		return
 	}
 
-	if found && node.IsLeaf {
-		node.Data = nil
+	t.untrack(node.Data)
+	node.IsLeaf = false
+	node.Data = nil
+	for i := len(word) - 1; i >= 0; i-- {
+		if n := path[i+1]; n.IsLeaf || len(n.Next) != 0 {
+			break
+		}
+		delete(path[i].Next, word[i])
 	}
 }
 
@@ -117,25 +351,15 @@ func (t *Trie) Get(name string) (*Record, bool) {
 	}
 	if r.IsExpired() {
 		t.remove(name)
+		if t.lru != nil {
+			t.lru.stats.Expired++
+		}
 		return nil, false
 	}
-
-	// update ttl
-	ttl := uint32(r.Expired.Sub(time.Now()))
-	updateTTLOf(r.Msg.Answer, ttl)
-	updateTTLOf(r.Msg.Ns, ttl)
-	updateTTLOf(r.Msg.Extra, ttl)
-	return r, true
-}
-
-func updateTTLOf(rrs []dns.RR, ttl uint32) {
-	if len(rrs) == 0 {
-		return
-	}
-	for i := range rrs {
-		h := rrs[i].Header()
-		h.Ttl = ttl
+	if r.elem != nil {
+		t.lru.list.MoveToFront(r.elem)
 	}
+	return r, true
 }
 
 // Find finds the data of the key `name`
@@ -146,6 +370,27 @@ func (t *Trie) Find(name string) (val interface{}, ok bool) {
 	return
 }
 
+// Match finds the data of the longest key which is name or a domain
+// suffix of name, e.g. the key "example.com." matches "www.example.com.",
+// and the key "." matches all the names.
+func (t *Trie) Match(name string) (val interface{}, ok bool) {
+	t.RLock()
+	defer t.RUnlock()
+
+	word, node := []rune(reverseString(name)), t
+	for i, c := range word {
+		if node = node.Next[c]; node == nil {
+			break
+		}
+		// the key must end at a label boundary of name
+		boundary := c == '.' || i+1 == len(word) || word[i+1] == '.'
+		if boundary && node.IsLeaf && node.Data != nil {
+			val, ok = node.Data, true
+		}
+	}
+	return
+}
+
 func (t *Trie) find(name string) (interface{}, bool) {
 
 	word, node := reverseString(name), t
@@ -0,0 +1,92 @@
+package dnsproxy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const defaultCacheSaveInterval = time.Minute * 5
+
+// cacheEntry is a record in the cache file.
+type cacheEntry struct {
+	Key      string    `json:"key"`
+	Stored   time.Time `json:"stored"`
+	Expired  time.Time `json:"expired"`
+	Security Security  `json:"security,omitempty"`
+	Msg      []byte    `json:"msg"` // in wire format
+}
+
+// saveCacheFile saves the unexpired records ranged by records to the file.
+func saveCacheFile(file string, records func(func(string, *Record) bool)) error {
+	var entries []cacheEntry
+	var err error
+	records(func(name string, r *Record) bool {
+		if r.IsExpired() {
+			return true
+		}
+		var msg []byte
+		if msg, err = r.Msg.Pack(); err != nil {
+			return false
+		}
+		entries = append(entries, cacheEntry{
+			Key:      name,
+			Stored:   r.Stored,
+			Expired:  r.Expired,
+			Security: r.Security,
+			Msg:      msg,
+		})
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+// loadCacheFile adds the unexpired records in the file by add.
+func loadCacheFile(file string, add func(string, *Record)) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var entries []cacheEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, e := range entries {
+		if now.After(e.Expired) {
+			continue
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(e.Msg); err != nil {
+			continue
+		}
+		add(e.Key, &Record{Stored: e.Stored, Expired: e.Expired, Msg: msg, Security: e.Security})
+	}
+	return nil
+}
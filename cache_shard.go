@@ -0,0 +1,205 @@
+package dnsproxy
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const maxCacheShards = 32
+
+// ShardedCache is a cache of the records for the concurrent workers, which
+// is sharded by the hash of the keys. The hits only take the read lock of
+// a shard, so the records must not be modified once added, and their
+// messages are copied by Record.Copy to respond. The expired records are
+// missed lazily, kept for the stale window to be got by GetStale, and
+// removed by Sweep, Add or the evictions.
+type ShardedCache struct {
+	shards []*cacheShard
+}
+
+type cacheShard struct {
+	sync.RWMutex
+	records map[string]*Record
+	lru     lru
+}
+
+// NewShardedCache creates a sharded cache, which evicts the least recently
+// used records of a shard once the shard has more than its part of
+// maxEntries records or maxBytes bytes, no limit if 0. The recently used
+// records are approximated by the second chances, as the hits do not
+// reorder the records under the read lock. The expired records are kept
+// for stale.
+func NewShardedCache(maxEntries, maxBytes int, stale time.Duration) *ShardedCache {
+	n := maxCacheShards
+	// every shard holds one record and the largest message at least
+	for (maxEntries > 0 && n > maxEntries) || (maxBytes > 0 && n > 1 && n*dns.MaxMsgSize > maxBytes) {
+		n /= 2
+	}
+
+	c := &ShardedCache{shards: make([]*cacheShard, n)}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{
+			records: make(map[string]*Record),
+			lru: lru{
+				list:       list.New(),
+				maxEntries: (maxEntries + n - 1) / n,
+				maxBytes:   (maxBytes + n - 1) / n,
+				stale:      stale,
+			},
+		}
+	}
+	return c
+}
+
+// shard gets the shard of key by its FNV-1a hash.
+func (c *ShardedCache) shard(key string) *cacheShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return c.shards[h&uint32(len(c.shards)-1)]
+}
+
+// Get gets the unexpired record of key.
+func (c *ShardedCache) Get(key string) (*Record, bool) {
+	s := c.shard(key)
+	s.RLock()
+	r, ok := s.records[key]
+	s.RUnlock()
+	if !ok || r.IsExpired() {
+		return nil, false
+	}
+	if atomic.LoadInt32(&r.used) == 0 {
+		atomic.StoreInt32(&r.used, 1)
+	}
+	return r, true
+}
+
+// GetStale gets the record of key, which may be expired but in the stale
+// window.
+func (c *ShardedCache) GetStale(key string) (*Record, bool) {
+	s := c.shard(key)
+	s.RLock()
+	r, ok := s.records[key]
+	s.RUnlock()
+	if !ok || s.lru.outdated(r) {
+		return nil, false
+	}
+	return r, true
+}
+
+// Add adds the record of key, and evicts the least recently used records
+// of the shard over the limits.
+func (c *ShardedCache) Add(key string, r *Record) {
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	s.remove(key)
+	r.key, r.size = key, len(key)+r.Msg.Len()
+	r.elem = s.lru.list.PushFront(r)
+	s.records[key] = r
+	s.lru.stats.Entries++
+	s.lru.stats.Bytes += r.size
+
+	l := &s.lru
+	for l.list.Len() > 0 && (l.maxEntries > 0 && l.stats.Entries > l.maxEntries ||
+		l.maxBytes > 0 && l.stats.Bytes > l.maxBytes) {
+		e := l.list.Back()
+		old := e.Value.(*Record)
+		expired := old.IsExpired()
+		if atomic.SwapInt32(&old.used, 0) == 1 && !expired {
+			l.list.MoveToFront(e) // second chance
+			continue
+		}
+		s.remove(old.key)
+		if expired {
+			l.stats.Expired++
+		} else {
+			l.stats.Evictions++
+		}
+	}
+}
+
+// Delete deletes the record of key.
+func (c *ShardedCache) Delete(key string) {
+	s := c.shard(key)
+	s.Lock()
+	s.remove(key)
+	s.Unlock()
+}
+
+func (s *cacheShard) remove(key string) {
+	r, ok := s.records[key]
+	if !ok {
+		return
+	}
+	delete(s.records, key)
+	s.lru.list.Remove(r.elem)
+	r.elem = nil
+	s.lru.stats.Entries--
+	s.lru.stats.Bytes -= r.size
+}
+
+// Stats gets the statistics of the cache.
+func (c *ShardedCache) Stats() CacheStats {
+	var stats CacheStats
+	for _, s := range c.shards {
+		s.RLock()
+		stats.Entries += s.lru.stats.Entries
+		stats.Bytes += s.lru.stats.Bytes
+		stats.Evictions += s.lru.stats.Evictions
+		stats.Expired += s.lru.stats.Expired
+		s.RUnlock()
+	}
+	return stats
+}
+
+// Sweep removes the expired records of the cache shard by shard, from the
+// least recently used one, holding the lock of a shard for sweepChunk
+// records at most once. The sweep stops early if done is closed. It gets
+// the number of the removed records.
+func (c *ShardedCache) Sweep(done <-chan struct{}) int {
+	n := 0
+	for _, s := range c.shards {
+		select {
+		case <-done:
+			return n
+		default:
+		}
+		n += s.lru.sweep(s, s.remove, done)
+	}
+	return n
+}
+
+// Range calls f for each record in the cache, until f returns false.
+func (c *ShardedCache) Range(f func(key string, r *Record) bool) {
+	for _, s := range c.shards {
+		s.RLock()
+		for key, r := range s.records {
+			if !f(key, r) {
+				s.RUnlock()
+				return
+			}
+		}
+		s.RUnlock()
+	}
+}
+
+// SaveFile saves the unexpired records of the cache to the file,
+// which is replaced atomically.
+func (c *ShardedCache) SaveFile(file string) error {
+	return saveCacheFile(file, c.Range)
+}
+
+// LoadFile loads the records from the file saved by SaveFile, the expired
+// ones are dropped, and the others keep their stored and expire time, so
+// their remaining ttl is reduced by the time passed since saved.
+func (c *ShardedCache) LoadFile(file string) error {
+	return loadCacheFile(file, c.Add)
+}
@@ -0,0 +1,256 @@
+package dnsproxy
+
+import (
+	"container/list"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestShardedCache(t *testing.T) {
+	c := NewShardedCache(maxCacheShards*2, 0, 0)
+	// the keys of a shard of 2 records
+	var keys []string
+	s := c.shard("a.0.example.")
+	for i := 0; len(keys) < 3; i++ {
+		if key := fmt.Sprintf("a.%d.example.", i); c.shard(key) == s {
+			keys = append(keys, key)
+		}
+	}
+
+	c.Add(keys[0], newTestRecord(keys[0][2:]))
+	c.Add(keys[1], newTestRecord(keys[1][2:]))
+	if _, ok := c.Get(keys[0]); !ok { // the second chance of keys[0]
+		t.Fatalf("%s is not found", keys[0])
+	}
+	c.Add(keys[2], newTestRecord(keys[2][2:]))
+	if _, ok := c.Get(keys[1]); ok {
+		t.Error("the least recently used record is not evicted")
+	}
+	if _, ok := c.Get(keys[0]); !ok {
+		t.Errorf("%s is evicted", keys[0])
+	}
+	if s := c.Stats(); s.Entries != 2 || s.Evictions != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	// the expired records are missed lazily, and removed by Sweep
+	r := newTestRecord(keys[2][2:])
+	r.Expired = time.Now().Add(-time.Second)
+	c.Add(keys[2], r)
+	if _, ok := c.Get(keys[2]); ok {
+		t.Error("got the expired record")
+	}
+	if s := c.Stats(); s.Entries != 2 || s.Expired != 0 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+	if n := c.Sweep(nil); n != 1 {
+		t.Errorf("removed %d records, expected 1", n)
+	}
+	if s := c.Stats(); s.Entries != 1 || s.Expired != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	file := filepath.Join(t.TempDir(), "cache.json")
+	if err := c.SaveFile(file); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewShardedCache(0, 0, 0)
+	if err := loaded.LoadFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.Get(keys[0]); !ok || loaded.Stats().Entries != 1 {
+		t.Errorf("unexpected loaded cache: %+v", loaded.Stats())
+	}
+}
+
+func TestShardedCacheFile(t *testing.T) {
+	c := NewShardedCache(0, 0, 0)
+	stored := time.Now().Add(-time.Second).Round(0)
+	for name, ttl := range map[string]time.Duration{
+		"a.www.example.": time.Minute,
+		"a.ftp.example.": time.Minute,
+		"a.old.example.": -time.Second,
+	} {
+		msg := new(dns.Msg).SetQuestion(name[2:], dns.TypeA)
+		rr, _ := dns.NewRR(name[2:] + " 60 IN A 192.0.2.1")
+		msg.Answer = append(msg.Answer, rr)
+		c.Add(name, &Record{Stored: stored, Expired: time.Now().Add(ttl), Msg: msg, Security: SecuritySecure})
+	}
+
+	file := filepath.Join(t.TempDir(), "cache.json")
+	if err := c.SaveFile(file); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewShardedCache(0, 0, 0)
+	if err := loaded.LoadFile(file); err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	loaded.Range(func(name string, r *Record) bool {
+		n++
+		if name != "a.www.example." && name != "a.ftp.example." {
+			t.Errorf("unexpected record %s", name)
+		}
+		if r.Security != SecuritySecure || len(r.Msg.Answer) != 1 || r.IsExpired() || !r.Stored.Equal(stored) {
+			t.Errorf("unexpected record of %s: %+v", name, r)
+		}
+		return true
+	})
+	if n != 2 {
+		t.Errorf("loaded %d records, expected 2", n)
+	}
+}
+
+// newTestShardedCache creates a cache of one unbounded shard.
+func newTestShardedCache() *ShardedCache {
+	return &ShardedCache{shards: []*cacheShard{{
+		records: make(map[string]*Record),
+		lru:     lru{list: list.New()},
+	}}}
+}
+
+func TestShardedCacheSweep(t *testing.T) {
+	c := newTestShardedCache()
+	n := sweepChunk*2 + 1
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("a.%d.example.", i)
+		r := newTestRecord(name[2:])
+		if i%2 == 0 {
+			r.Expired = time.Now().Add(-time.Second)
+		}
+		c.Add(name, r)
+	}
+
+	if removed := c.Sweep(nil); removed != sweepChunk+1 {
+		t.Errorf("removed %d records, expected %d", removed, sweepChunk+1)
+	}
+	if s := c.Stats(); s.Entries != sweepChunk || s.Expired != sweepChunk+1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+	if _, ok := c.Get("a.1.example."); !ok {
+		t.Error("the unexpired record is removed")
+	}
+	if _, ok := c.GetStale("a.2.example."); ok {
+		t.Error("the expired record is not removed")
+	}
+}
+
+func TestShardedCacheSweepRestart(t *testing.T) {
+	c := newTestShardedCache()
+	for _, name := range []string{"a.a.example.", "a.b.example.", "a.c.example."} {
+		r := newTestRecord(name[2:])
+		r.Expired = time.Now().Add(-time.Second)
+		c.Add(name, r)
+	}
+
+	// the next record to check is removed meanwhile
+	s := c.shards[0]
+	removed := false
+	n := s.lru.sweep(s, func(key string) {
+		s.remove(key)
+		if !removed {
+			removed = true
+			s.remove("a.b.example.")
+		}
+	}, nil)
+	if n != 2 || c.Stats().Entries != 0 {
+		t.Errorf("removed %d records, %d records left", n, c.Stats().Entries)
+	}
+}
+
+func TestShardedCacheStale(t *testing.T) {
+	c := NewShardedCache(0, 0, time.Minute)
+	for name, expired := range map[string]time.Duration{
+		"a.stale.example.": -time.Second,
+		"a.old.example.":   -time.Hour,
+	} {
+		r := newTestRecord(name[2:])
+		r.Expired = time.Now().Add(expired)
+		c.Add(name, r)
+	}
+
+	if _, ok := c.Get("a.stale.example."); ok {
+		t.Error("got the stale record")
+	}
+	if _, ok := c.GetStale("a.stale.example."); !ok {
+		t.Error("the stale record is not found")
+	}
+	if _, ok := c.GetStale("a.old.example."); ok {
+		t.Error("got the record out of the stale window")
+	}
+	if n := c.Sweep(nil); n != 1 {
+		t.Errorf("removed %d records, expected 1", n)
+	}
+	if _, ok := c.GetStale("a.stale.example."); !ok {
+		t.Error("the stale record is removed")
+	}
+}
+
+func TestShardedCacheShards(t *testing.T) {
+	for _, tt := range []struct {
+		maxEntries, maxBytes, shards int
+	}{
+		{0, 0, maxCacheShards},
+		{10, 0, 8},
+		{0, 1 << 20, 16},
+		{1, 1 << 30, 1},
+		{0, 100, 1},
+	} {
+		if n := len(NewShardedCache(tt.maxEntries, tt.maxBytes, 0).shards); n != tt.shards {
+			t.Errorf("got %d shards of %d entries and %d bytes, expected %d", n, tt.maxEntries, tt.maxBytes, tt.shards)
+		}
+	}
+}
+
+// benchmarkCache gets the records from the cache by the parallel workers,
+// adding one per writes gets if writes is not 0.
+func benchmarkCache(b *testing.B, get func(string) (*Record, bool), add func(string, *Record), writes int) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("a.%d.example.", i)
+		add(keys[i], newTestRecord(keys[i][2:]))
+	}
+
+	var seq uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint32(&seq, 1)) * 7919
+		for pb.Next() {
+			i++
+			key := keys[i%len(keys)]
+			if writes != 0 && i%writes == 0 {
+				add(key, newTestRecord(key[2:]))
+				continue
+			}
+			get(key)
+		}
+	})
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	b.Run("Trie", func(b *testing.B) {
+		trie := NewBoundedTrie(0, 0)
+		benchmarkCache(b, trie.Get, trie.Add, 0)
+	})
+	b.Run("Sharded", func(b *testing.B) {
+		c := NewShardedCache(0, 0, 0)
+		benchmarkCache(b, c.Get, c.Add, 0)
+	})
+}
+
+func BenchmarkCacheMixed(b *testing.B) {
+	b.Run("Trie", func(b *testing.B) {
+		trie := NewBoundedTrie(0, 0)
+		benchmarkCache(b, trie.Get, trie.Add, 10)
+	})
+	b.Run("Sharded", func(b *testing.B) {
+		c := NewShardedCache(0, 0, 0)
+		benchmarkCache(b, c.Get, c.Add, 10)
+	})
+}
@@ -1,6 +1,11 @@
 package dnsproxy
 
-import "testing"
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
 
 func TestTrie(t *testing.T) {
 	trie := NewTrie()
@@ -22,3 +27,164 @@ func testTrie(trie *Trie, key, val string, t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestTrieMatch(t *testing.T) {
+	trie := NewTrie()
+	trie.Insert("example.com.", "example")
+	trie.Insert("corp.example.com.", "corp")
+
+	for name, expected := range map[string]interface{}{
+		"example.com.":          "example",
+		"www.example.com.":      "example",
+		"corp.example.com.":     "corp",
+		"www.corp.example.com.": "corp",
+		"xcorp.example.com.":    "example",
+		"badexample.com.":       nil,
+		"example.org.":          nil,
+	} {
+		if v, _ := trie.Match(name); v != expected {
+			t.Errorf("Match %s: %v, expected: %v", name, v, expected)
+		}
+	}
+
+	trie.Insert(".", "root")
+	if v, _ := trie.Match("example.org."); v != "root" {
+		t.Errorf("Match example.org.: %v, expected: root", v)
+	}
+}
+
+func TestNewNegativeRecord(t *testing.T) {
+	soa, _ := dns.NewRR("example. 300 SOA ns.example. admin.example. 1 3600 600 86400 60")
+	q := new(dns.Msg).SetQuestion("www.example.", dns.TypeAAAA)
+
+	nodata := new(dns.Msg).SetReply(q)
+	nodata.Ns = []dns.RR{soa}
+	r, ok := NewRecord(nodata)
+	if !ok || !r.IsNoData() || r.IsNXDomain() {
+		t.Fatalf("unexpected NODATA record: %v, %v", r, ok)
+	}
+	if ttl := time.Until(r.Expired); ttl > time.Minute || ttl < time.Minute-time.Second {
+		t.Errorf("unexpected ttl of the negative record: %v, expected: SOA MINIMUM 1m", ttl)
+	}
+
+	nxdomain := new(dns.Msg).SetRcode(q, dns.RcodeNameError)
+	nxdomain.Ns = []dns.RR{soa}
+	if r, ok := NewRecord(nxdomain); !ok || !r.IsNXDomain() || r.IsNoData() {
+		t.Errorf("unexpected NXDOMAIN record: %v, %v", r, ok)
+	}
+
+	nxdomain.Ns = nil
+	if _, ok := NewRecord(nxdomain); ok {
+		t.Error("cached the negative response without SOA")
+	}
+}
+
+func TestRecordTTL(t *testing.T) {
+	msg := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+	for _, s := range []string{
+		"www.example. 3600 CNAME www.cdn.example.",
+		"www.cdn.example. 30 A 192.0.2.1",
+		"www.cdn.example. 600 A 192.0.2.2",
+	} {
+		rr, _ := dns.NewRR(s)
+		msg.Answer = append(msg.Answer, rr)
+	}
+	msg.SetEdns0(dnssecUDPSize, true)
+
+	r, ok := NewRecord(msg.Copy())
+	if !ok {
+		t.Fatal("failed to create the record")
+	}
+	if ttl := r.Expired.Sub(r.Stored); ttl != 30*time.Second {
+		t.Errorf("unexpected ttl of the record: %v, expected the min 30s", ttl)
+	}
+
+	r.Stored = r.Stored.Add(-100 * time.Second)
+	cached := r.Copy()
+	for i, ttl := range []uint32{3500, 0, 500} {
+		if got := cached.Answer[i].Header().Ttl; got != ttl {
+			t.Errorf("unexpected ttl of %v: %d, expected %d", cached.Answer[i], got, ttl)
+		}
+	}
+	if opt := cached.IsEdns0(); opt == nil || !opt.Do() {
+		t.Errorf("the OPT record is decayed: %v", opt)
+	}
+	if r.Msg.Answer[0].Header().Ttl != 3600 {
+		t.Error("the cached message is modified")
+	}
+
+	r, _ = newRecord(msg.Copy(), time.Minute, 10*time.Minute)
+	if ttl := r.Expired.Sub(r.Stored); ttl != time.Minute {
+		t.Errorf("unexpected ttl of the clamped record: %v, expected 1m", ttl)
+	}
+	for i, ttl := range []uint32{600, 60, 600} {
+		if got := r.Msg.Answer[i].Header().Ttl; got != ttl {
+			t.Errorf("unexpected clamped ttl of %v: %d, expected %d", r.Msg.Answer[i], got, ttl)
+		}
+	}
+}
+
+func newTestRecord(name string) *Record {
+	msg := new(dns.Msg).SetQuestion(name, dns.TypeA)
+	rr, _ := dns.NewRR(name + " 60 IN A 192.0.2.1")
+	msg.Answer = append(msg.Answer, rr)
+	r, _ := NewRecord(msg)
+	return r
+}
+
+func TestBoundedTrie(t *testing.T) {
+	trie := NewBoundedTrie(2, 0)
+	trie.Add("a.a.example.", newTestRecord("a.example."))
+	trie.Add("a.b.example.", newTestRecord("b.example."))
+	trie.Get("a.a.example.") // b is the least recently used
+	trie.Add("a.c.example.", newTestRecord("c.example."))
+
+	if _, ok := trie.Find("a.b.example."); ok {
+		t.Error("the least recently used record is not evicted")
+	}
+	for _, name := range []string{"a.a.example.", "a.c.example."} {
+		if _, ok := trie.Find(name); !ok {
+			t.Errorf("%s is evicted", name)
+		}
+	}
+	if s := trie.Stats(); s.Entries != 2 || s.Evictions != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+	// the evicted branch is pruned
+	expected := NewTrie()
+	expected.Insert("a.a.example.", nil)
+	expected.Insert("a.c.example.", nil)
+	if n, en := countNodes(trie), countNodes(expected); n != en {
+		t.Errorf("got %d nodes, expected %d", n, en)
+	}
+
+	size := trie.Stats().Bytes / 2
+	trie = NewBoundedTrie(0, size*3/2)
+	trie.Add("a.a.example.", newTestRecord("a.example."))
+	trie.Add("a.b.example.", newTestRecord("b.example."))
+	if s := trie.Stats(); s.Entries != 1 || s.Bytes != size || s.Evictions != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
+
+func countNodes(t *Trie) int {
+	n := 1
+	for _, next := range t.Next {
+		n += countNodes(next)
+	}
+	return n
+}
+
+func TestTriePrune(t *testing.T) {
+	trie := NewTrie()
+	trie.Insert("www.example.", 1)
+	trie.Insert("example.", 2)
+	trie.Delete("www.example.")
+	if v, ok := trie.Find("example."); !ok || v != 2 {
+		t.Errorf("the parent key is pruned")
+	}
+	trie.Delete("example.")
+	if n := countNodes(trie); n != 1 {
+		t.Errorf("the empty branch is not pruned, %d nodes", n)
+	}
+}
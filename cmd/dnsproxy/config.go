@@ -5,10 +5,43 @@ import toml "github.com/pelletier/go-toml"
 type config struct {
 	Addr          string   `toml:"addr"`
 	UpServers     []string `toml:"servers"`
+	Strategy      string   `toml:"strategy"`
+	Recursive     bool     `toml:"recursive"`
+	RootHints     string   `toml:"root-hints"`
+	DNSSEC        bool     `toml:"dnssec"`
+	TrustAnchors  []string `toml:"trust-anchors"`
 	WithCache     bool     `toml:"with-cache"`
 	CacheFile     string   `toml:"cache-file"`
+	CacheSave     int      `toml:"cache-save-interval"` // in seconds
+	CacheEntries  int      `toml:"cache-max-entries"`
+	CacheBytes    int      `toml:"cache-max-bytes"`
+	CacheSweep    int      `toml:"cache-sweep-interval"` // in seconds
 	WorkerPoolMin int      `toml:"worker-pool-min"`
 	WorkerPoolMax int      `toml:"worker-pool-max"`
+	UDPMaxSize    int      `toml:"udp-max-size"`
+
+	HTTPSAddr      string   `toml:"https-addr"`
+	TLSAddr        string   `toml:"tls-addr"`
+	CertFile       string   `toml:"cert-file"`
+	KeyFile        string   `toml:"key-file"`
+	ClientCAFile   string   `toml:"client-ca-file"`
+	TrustedProxies []string `toml:"trusted-proxies"`
+
+	Weights  map[string]int      `toml:"weights"`
+	Forwards map[string][]string `toml:"forwards"`
+
+	HealthProbe    string `toml:"health-probe"`
+	HealthInterval int    `toml:"health-interval"` // in seconds
+
+	MinTTL int `toml:"min-ttl"` // in seconds
+	MaxTTL int `toml:"max-ttl"` // in seconds
+
+	StaleWindow  int `toml:"stale-window"`         // in seconds
+	StaleTimeout int `toml:"stale-answer-timeout"` // in milliseconds
+	StaleTTL     int `toml:"stale-answer-ttl"`     // in seconds
+	StaleRecheck int `toml:"stale-recheck"`        // in seconds
+
+	TCPIdleTimeout int `toml:"tcp-idle-timeout"` // in seconds, of the tcp, tls and https clients
 }
 
 func loadConfig(fp string) (*config, error) {
@@ -25,10 +58,14 @@ func defaultConfig() ([]byte, error) {
 	cfg := &config{
 		Addr:          ":53",
 		UpServers:     []string{"8.8.8.8"},
+		Strategy:      "sequential",
 		WithCache:     true,
 		CacheFile:     "cache.json",
+		CacheSave:     300,
+		CacheSweep:    60,
 		WorkerPoolMin: 10,
 		WorkerPoolMax: 100,
+		UDPMaxSize:    4096,
 	}
 	return toml.Marshal(cfg)
 }
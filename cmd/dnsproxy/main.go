@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	dnsproxy "github.com/Asphaltt/dnsproxy-go"
 )
@@ -34,10 +35,44 @@ func main() {
 	serverCfg := &dnsproxy.Config{
 		Addr:          cfg.Addr,
 		UpServers:     cfg.UpServers,
+		Strategy:      cfg.Strategy,
+		Recursive:     cfg.Recursive,
+		RootHints:     cfg.RootHints,
+		DNSSEC:        cfg.DNSSEC,
+		TrustAnchors:  cfg.TrustAnchors,
+		Weights:       cfg.Weights,
+		Forwards:      cfg.Forwards,
 		WithCache:     cfg.WithCache,
 		CacheFile:     cfg.CacheFile,
 		WorkerPoolMin: cfg.WorkerPoolMin,
 		WorkerPoolMax: cfg.WorkerPoolMax,
+		UDPMaxSize:    cfg.UDPMaxSize,
+
+		HealthProbe:    cfg.HealthProbe,
+		HealthInterval: time.Duration(cfg.HealthInterval) * time.Second,
+
+		CacheSaveInterval: time.Duration(cfg.CacheSave) * time.Second,
+		CacheMaxEntries:   cfg.CacheEntries,
+		CacheMaxBytes:     cfg.CacheBytes,
+
+		CacheSweepInterval: time.Duration(cfg.CacheSweep) * time.Second,
+
+		CacheMinTTL: time.Duration(cfg.MinTTL) * time.Second,
+		CacheMaxTTL: time.Duration(cfg.MaxTTL) * time.Second,
+
+		CacheStaleWindow:     time.Duration(cfg.StaleWindow) * time.Second,
+		StaleAnswerTimeout:   time.Duration(cfg.StaleTimeout) * time.Millisecond,
+		StaleAnswerTTL:       time.Duration(cfg.StaleTTL) * time.Second,
+		StaleRecheckInterval: time.Duration(cfg.StaleRecheck) * time.Second,
+
+		TCPIdleTimeout: time.Duration(cfg.TCPIdleTimeout) * time.Second,
+
+		HTTPSAddr:      cfg.HTTPSAddr,
+		TLSAddr:        cfg.TLSAddr,
+		CertFile:       cfg.CertFile,
+		KeyFile:        cfg.KeyFile,
+		ClientCAFile:   cfg.ClientCAFile,
+		TrustedProxies: cfg.TrustedProxies,
 	}
 
 	if err := dnsproxy.Start(serverCfg); err != nil {
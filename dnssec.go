@@ -0,0 +1,684 @@
+package dnsproxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Security is the DNSSEC validation state of a response.
+type Security uint8
+
+// DNSSEC validation states
+const (
+	// SecurityUnknown is of the responses not validated
+	SecurityUnknown Security = iota
+	// SecurityInsecure is of the responses proven to be unsigned
+	SecurityInsecure
+	// SecuritySecure is of the responses validated from the trust anchors
+	SecuritySecure
+	// SecurityBogus is of the responses failed to be validated
+	SecurityBogus
+)
+
+func (s Security) String() string {
+	switch s {
+	case SecurityInsecure:
+		return "insecure"
+	case SecuritySecure:
+		return "secure"
+	case SecurityBogus:
+		return "bogus"
+	}
+	return "unknown"
+}
+
+// rootAnchor is the DS of the root KSK-2017.
+const rootAnchor = ". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+
+const (
+	maxChainDepth = 16        // nested validating of the DS and DNSKEY RRsets
+	maxKeysTTL    = time.Hour // max time to cache the validated keys
+	maxZoneKeys   = 10000     // cached zone keys, the least recently used evicted
+	dnssecUDPSize = 4096      // EDNS0 udp size of the queries with DO
+)
+
+// validator validates the responses from the trust anchors,
+// the DS and DNSKEY RRsets are queried with query.
+type validator struct {
+	anchors map[string][]*dns.DS
+	query   func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+	zones   *Trie // zone name to *Record of the *zoneKeys
+}
+
+// zoneKeys is the validated DNSKEYs of a zone. There are no keys if the
+// zone is insecure, or the name is not a zone cut in its secure parent.
+type zoneKeys struct {
+	security Security
+	keys     []*dns.DNSKEY
+	expired  time.Time
+}
+
+// newValidator creates a validator with the DS or DNSKEY RRs of the trust
+// anchors, the root KSK is used if anchors is empty.
+func newValidator(anchors []string, query func(context.Context, *dns.Msg) (*dns.Msg, error)) (*validator, error) {
+	if len(anchors) == 0 {
+		anchors = []string{rootAnchor}
+	}
+
+	v := &validator{
+		anchors: make(map[string][]*dns.DS),
+		query:   query,
+		zones:   NewBoundedTrie(maxZoneKeys, 0),
+	}
+	for _, s := range anchors {
+		rr, err := dns.NewRR(s)
+		if err != nil || rr == nil {
+			return nil, fmt.Errorf("%w: trust anchor %s", ErrInvalidConfig, s)
+		}
+		var ds *dns.DS
+		switch rr := rr.(type) {
+		case *dns.DS:
+			ds = rr
+		case *dns.DNSKEY:
+			ds = rr.ToDS(dns.SHA256)
+		}
+		if ds == nil {
+			return nil, fmt.Errorf("%w: trust anchor %s", ErrInvalidConfig, s)
+		}
+		zone := canonicalName(ds.Hdr.Name)
+		v.anchors[zone] = append(v.anchors[zone], ds)
+	}
+	return v, nil
+}
+
+// validate validates the response of the up dns servers,
+// the NXDOMAIN and NODATA responses must be proven by NSEC or NSEC3.
+func (v *validator) validate(ctx context.Context, msg *dns.Msg) Security {
+	if len(msg.Question) == 0 || msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return SecurityUnknown
+	}
+
+	sec := v.verify(ctx, msg, 0)
+	if sec != SecuritySecure {
+		return sec
+	}
+
+	// the RRsets expanded from the wildcards, whose RRSIGs have fewer
+	// labels than the owners, must prove that the owners do not exist
+	for _, rr := range msg.Answer {
+		sig, ok := rr.(*dns.RRSIG)
+		if ok && int(sig.Labels) < dns.CountLabel(sig.Hdr.Name) && !wildcardProof(msg.Ns, sig.Hdr.Name, int(sig.Labels)) {
+			return SecurityBogus
+		}
+	}
+
+	q := msg.Question[0]
+	rrs, target, err := chase(msg.Answer, canonicalName(q.Name), q.Qtype, ".")
+	if err != nil {
+		return SecurityBogus
+	}
+	if target == "" {
+		// the end of the CNAME chain
+		target = q.Name
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == q.Qtype {
+				return SecuritySecure
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				target = cname.Target
+			}
+		}
+	}
+	_, sec = denial(msg, target, q.Qtype)
+	return sec
+}
+
+// verify verifies the RRsets of the answer, and the SOA, NSEC and NSEC3
+// RRsets of the authority.
+func (v *validator) verify(ctx context.Context, msg *dns.Msg, depth int) Security {
+	sets, sigs := rrsets(msg.Answer)
+	nsSets, nsSigs := rrsets(msg.Ns)
+	for _, set := range nsSets {
+		switch set[0].Header().Rrtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3:
+			sets = append(sets, set)
+		}
+	}
+	sigs = append(sigs, nsSigs...)
+
+	if len(sets) == 0 {
+		return v.zoneSecurity(ctx, msg.Question[0].Name, depth)
+	}
+	sec := SecuritySecure
+	for _, set := range sets {
+		switch v.verifySet(ctx, set, sigs, depth) {
+		case SecurityBogus:
+			return SecurityBogus
+		case SecurityInsecure:
+			sec = SecurityInsecure
+		}
+	}
+	return sec
+}
+
+// verifySet verifies the RRset by one of its RRSIGs,
+// the unsigned RRset is insecure only in an insecure zone.
+func (v *validator) verifySet(ctx context.Context, set []dns.RR, sigs []*dns.RRSIG, depth int) Security {
+	h := set[0].Header()
+	signed := false
+	for _, sig := range sigs {
+		if sig.TypeCovered != h.Rrtype || !strings.EqualFold(sig.Hdr.Name, h.Name) {
+			continue
+		}
+		signed = true
+		signer := canonicalName(sig.SignerName)
+		if !dns.IsSubDomain(signer, h.Name) {
+			continue
+		}
+
+		zk := v.keys(ctx, signer, depth+1)
+		if zk.security == SecurityInsecure {
+			return SecurityInsecure
+		}
+		if zk.security == SecuritySecure && verifySig(sig, zk.keys, set) {
+			return SecuritySecure
+		}
+	}
+	if !signed && v.zoneSecurity(ctx, h.Name, depth) == SecurityInsecure {
+		return SecurityInsecure
+	}
+	return SecurityBogus
+}
+
+func verifySig(sig *dns.RRSIG, keys []*dns.DNSKEY, set []dns.RR) bool {
+	if !sig.ValidityPeriod(time.Now()) {
+		return false
+	}
+	for _, key := range keys {
+		if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, set) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneSecurity gets whether the unsigned name is in an insecure zone,
+// by finding a delegation without DS from its closest trust anchor.
+func (v *validator) zoneSecurity(ctx context.Context, name string, depth int) Security {
+	name = canonicalName(name)
+	labels := dns.SplitDomainName(name)
+	anchor := -1
+	for i := 0; i <= len(labels); i++ {
+		if _, ok := v.anchors[dns.Fqdn(strings.Join(labels[i:], "."))]; ok {
+			anchor = i
+			break
+		}
+	}
+	if anchor < 0 {
+		return SecurityInsecure
+	}
+
+	for i := anchor - 1; i >= 0; i-- {
+		switch v.keys(ctx, dns.Fqdn(strings.Join(labels[i:], ".")), depth+1).security {
+		case SecurityInsecure:
+			return SecurityInsecure
+		case SecurityBogus:
+			return SecurityBogus
+		}
+	}
+	return SecuritySecure
+}
+
+// keys gets the validated DNSKEYs of the zone.
+func (v *validator) keys(ctx context.Context, zone string, depth int) *zoneKeys {
+	if depth > maxChainDepth {
+		return &zoneKeys{security: SecurityBogus}
+	}
+
+	zone = canonicalName(zone)
+	if r, ok := v.zones.Get(zone); ok {
+		return r.data.(*zoneKeys)
+	}
+	zk := v.fetchKeys(ctx, zone, depth)
+	if zk.security != SecurityBogus {
+		v.zones.Add(zone, &Record{Stored: time.Now(), Expired: zk.expired, data: zk})
+	}
+	return zk
+}
+
+// exchange queries the DS or DNSKEY RRset, the failures and the replies
+// to other questions are invalid.
+func (v *validator) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	m, err := v.query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if !isReplyTo(q, m) || m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return nil, ErrInvalidResponse
+	}
+	return m, nil
+}
+
+// fetchKeys validates the DS RRset of the zone from its parent,
+// and the DNSKEY RRset of the zone by the DS RRset.
+func (v *validator) fetchKeys(ctx context.Context, zone string, depth int) *zoneKeys {
+	bogus := &zoneKeys{security: SecurityBogus}
+
+	ds, ok := v.anchors[zone]
+	if !ok {
+		if zone == "." {
+			return &zoneKeys{security: SecurityInsecure, expired: time.Now().Add(maxKeysTTL)}
+		}
+		m, err := v.exchange(ctx, newDNSSECQuery(zone, dns.TypeDS))
+		if err != nil {
+			return bogus
+		}
+		if sec := v.verify(ctx, m, depth); sec != SecuritySecure {
+			return &zoneKeys{security: sec, expired: time.Now().Add(rrsetTTL(m))}
+		}
+		for _, rr := range m.Answer {
+			if rr, ok := rr.(*dns.DS); ok && strings.EqualFold(rr.Hdr.Name, zone) {
+				ds = append(ds, rr)
+			}
+		}
+		if len(ds) == 0 {
+			types, sec := denial(m, zone, dns.TypeDS)
+			if sec == SecurityBogus {
+				return bogus
+			}
+			zk := &zoneKeys{security: sec, expired: time.Now().Add(rrsetTTL(m))}
+			for _, t := range types {
+				if t == dns.TypeNS {
+					// a delegation without DS
+					zk.security = SecurityInsecure
+				}
+			}
+			return zk
+		}
+	}
+
+	m, err := v.exchange(ctx, newDNSSECQuery(zone, dns.TypeDNSKEY))
+	if err != nil {
+		return bogus
+	}
+	var keys []*dns.DNSKEY
+	var set []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range m.Answer {
+		if !strings.EqualFold(rr.Header().Name, zone) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, rr)
+			set = append(set, rr)
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+
+	// the DNSKEY RRset must be signed by a key of the DS RRset
+	for _, key := range keys {
+		if !matchDS(key, ds) {
+			continue
+		}
+		for _, sig := range sigs {
+			if verifySig(sig, []*dns.DNSKEY{key}, set) {
+				ttl := time.Duration(set[0].Header().Ttl) * time.Second
+				if ttl > maxKeysTTL {
+					ttl = maxKeysTTL
+				}
+				return &zoneKeys{security: SecuritySecure, keys: keys, expired: time.Now().Add(ttl)}
+			}
+		}
+	}
+	return bogus
+}
+
+func matchDS(key *dns.DNSKEY, ds []*dns.DS) bool {
+	for _, d := range ds {
+		if key.KeyTag() != d.KeyTag || key.Algorithm != d.Algorithm {
+			continue
+		}
+		if kd := key.ToDS(d.DigestType); kd != nil && strings.EqualFold(kd.Digest, d.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// denial gets whether the NSEC or NSEC3 RRs of the authority prove that
+// name does not exist for NXDOMAIN, or does not have the type for NODATA,
+// as RFC 4035 section 5.4 and RFC 5155 section 8. The types of name are
+// returned for NODATA. It gets SecurityInsecure if the proof lies in an
+// opt-out span of NSEC3, where the unsigned delegations may exist.
+func denial(msg *dns.Msg, name string, qtype uint16) ([]uint16, Security) {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range msg.Ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+	nxdomain := msg.Rcode == dns.RcodeNameError
+	if len(nsecs) != 0 {
+		return denialNSEC(nsecs, name, qtype, nxdomain)
+	}
+	return denialNSEC3(nsec3s, name, qtype, nxdomain)
+}
+
+// denialNSEC proves the denial by NSEC. Besides the NSEC covering name,
+// NXDOMAIN must prove that the wildcard of the closest encloser does not
+// exist, and NODATA of a wildcard that the wildcard does not have the type.
+func denialNSEC(nsecs []*dns.NSEC, name string, qtype uint16, nxdomain bool) ([]uint16, Security) {
+	if !nxdomain {
+		for _, rr := range nsecs {
+			if strings.EqualFold(rr.Hdr.Name, name) {
+				if noData(rr.TypeBitMap, qtype) {
+					return rr.TypeBitMap, SecuritySecure
+				}
+				return nil, SecurityBogus
+			}
+		}
+	}
+
+	var cover *dns.NSEC
+	for _, rr := range nsecs {
+		if coverNSEC(rr, name) {
+			cover = rr
+			break
+		}
+	}
+	if cover == nil {
+		return nil, SecurityBogus
+	}
+	if dns.IsSubDomain(name, cover.NextDomain) {
+		// an empty non-terminal, which exists without any type
+		if nxdomain {
+			return nil, SecurityBogus
+		}
+		return nil, SecuritySecure
+	}
+
+	wildcard := "*." + encloserNSEC(cover, name)
+	for _, rr := range nsecs {
+		if nxdomain && coverNSEC(rr, wildcard) {
+			return nil, SecuritySecure
+		}
+		if !nxdomain && strings.EqualFold(rr.Hdr.Name, wildcard) && noData(rr.TypeBitMap, qtype) {
+			return rr.TypeBitMap, SecuritySecure
+		}
+	}
+	return nil, SecurityBogus
+}
+
+// denialNSEC3 proves the denial by NSEC3. Without the NSEC3 matching
+// name, the closest encloser must be proven, and the wildcard of it does
+// not exist for NXDOMAIN, or does not have the type for NODATA. DS NODATA
+// in an opt-out span needs no wildcard proof.
+func denialNSEC3(nsec3s []*dns.NSEC3, name string, qtype uint16, nxdomain bool) ([]uint16, Security) {
+	if !nxdomain {
+		for _, rr := range nsec3s {
+			if rr.Match(name) {
+				if noData(rr.TypeBitMap, qtype) {
+					return rr.TypeBitMap, SecuritySecure
+				}
+				return nil, SecurityBogus
+			}
+		}
+	}
+
+	ce, cover := closestEncloser(nsec3s, name)
+	if cover == nil {
+		return nil, SecurityBogus
+	}
+	optOut := cover.Flags&1 == 1
+	if !nxdomain && qtype == dns.TypeDS && optOut {
+		return nil, SecurityInsecure
+	}
+
+	sec := SecuritySecure
+	if optOut {
+		sec = SecurityInsecure
+	}
+	wildcard := "*." + ce
+	if ce == "." {
+		wildcard = "*."
+	}
+	for _, rr := range nsec3s {
+		if nxdomain && rr.Cover(wildcard) {
+			return nil, sec
+		}
+		if !nxdomain && rr.Match(wildcard) && noData(rr.TypeBitMap, qtype) {
+			return rr.TypeBitMap, sec
+		}
+	}
+	return nil, SecurityBogus
+}
+
+// closestEncloser gets the closest encloser of name proven by the NSEC3
+// RRs, the longest ancestor matched, and the NSEC3 covering the next
+// closer name, one label longer than it, as RFC 5155 section 8.3.
+func closestEncloser(nsec3s []*dns.NSEC3, name string) (string, *dns.NSEC3) {
+	labels := dns.SplitDomainName(name)
+	for i := 1; i <= len(labels); i++ {
+		ce := dns.Fqdn(strings.Join(labels[i:], "."))
+		matched := false
+		for _, rr := range nsec3s {
+			if rr.Match(ce) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		next := dns.Fqdn(strings.Join(labels[i-1:], "."))
+		for _, rr := range nsec3s {
+			if rr.Cover(next) {
+				return ce, rr
+			}
+		}
+		return "", nil
+	}
+	return "", nil
+}
+
+// encloserNSEC gets the closest encloser of name covered by the NSEC,
+// the longer common ancestor of name with the owner and the next name.
+func encloserNSEC(nsec *dns.NSEC, name string) string {
+	n := dns.CompareDomainName(name, nsec.Hdr.Name)
+	if m := dns.CompareDomainName(name, nsec.NextDomain); m > n {
+		n = m
+	}
+	labels := dns.SplitDomainName(name)
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// wildcardProof gets whether the NSEC or NSEC3 RRs prove that name, the
+// owner of the RRset expanded from the wildcard of its ancestor of labels,
+// does not exist, as RFC 4035 section 5.3.4 and RFC 5155 section 8.8.
+func wildcardProof(rrs []dns.RR, name string, labels int) bool {
+	names := dns.SplitDomainName(name)
+	if labels >= len(names) {
+		return false
+	}
+	next := dns.Fqdn(strings.Join(names[len(names)-labels-1:], "."))
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if coverNSEC(rr, name) {
+				return true
+			}
+		case *dns.NSEC3:
+			if rr.Cover(next) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// noData gets whether the types of a name prove that it does not have
+// qtype. The types of a delegation, NS without SOA, only prove that it
+// has no DS, while the types of a zone apex can not prove that.
+func noData(types []uint16, qtype uint16) bool {
+	if hasType(types, qtype) {
+		return false
+	}
+	var ns, soa bool
+	for _, t := range types {
+		ns = ns || t == dns.TypeNS
+		soa = soa || t == dns.TypeSOA
+	}
+	if qtype == dns.TypeDS {
+		return !soa
+	}
+	return !ns || soa
+}
+
+func hasType(types []uint16, qtype uint16) bool {
+	for _, t := range types {
+		if t == qtype || t == dns.TypeCNAME {
+			return true
+		}
+	}
+	return false
+}
+
+// coverNSEC gets whether name is between the owner and the next name
+// of the NSEC in the canonical order.
+func coverNSEC(nsec *dns.NSEC, name string) bool {
+	after := canonicalCompare(nsec.Hdr.Name, name) < 0
+	if canonicalCompare(nsec.Hdr.Name, nsec.NextDomain) < 0 {
+		return after && canonicalCompare(name, nsec.NextDomain) < 0
+	}
+	// the last NSEC of the zone
+	return after
+}
+
+// canonicalCompare compares the names in the canonical order of RFC 4034.
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// rrsets groups the RRs by the owner and the type,
+// and gets the RRSIGs apart.
+func rrsets(rrs []dns.RR) ([][]dns.RR, []*dns.RRSIG) {
+	var sets [][]dns.RR
+	var sigs []*dns.RRSIG
+	index := make(map[string]int)
+	for _, rr := range rrs {
+		h := rr.Header()
+		switch rr := rr.(type) {
+		case *dns.RRSIG:
+			sigs = append(sigs, rr)
+			continue
+		case *dns.OPT:
+			continue
+		}
+		key := strings.ToLower(h.Name) + "/" + dns.TypeToString[h.Rrtype]
+		if i, ok := index[key]; ok {
+			sets[i] = append(sets[i], rr)
+			continue
+		}
+		index[key] = len(sets)
+		sets = append(sets, []dns.RR{rr})
+	}
+	return sets, sigs
+}
+
+// rrsetTTL gets the min ttl of the RRs in the answer and the authority,
+// capped by maxKeysTTL.
+func rrsetTTL(msg *dns.Msg) time.Duration {
+	ttl := uint32(maxKeysTTL / time.Second)
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range rrs {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+func newDNSSECQuery(name string, qtype uint16) *dns.Msg {
+	msg := new(dns.Msg).SetQuestion(name, qtype)
+	msg.SetEdns0(dnssecUDPSize, true)
+	return msg
+}
+
+// isDNSSECType gets whether the RR type is added for the DNSSEC.
+func isDNSSECType(rrtype uint16) bool {
+	switch rrtype {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		return true
+	}
+	return false
+}
+
+// dnssecMiddleware queries with DO set, and removes the DNSSEC RRs from
+// the responses to the clients without DO.
+func (p *Proxy) dnssecMiddleware(next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *dns.Msg) {
+		opt := r.IsEdns0()
+		if opt != nil && opt.Do() {
+			next.ServeDNS(ctx, w, r)
+			return
+		}
+
+		q := r.Copy()
+		if o := q.IsEdns0(); o != nil {
+			o.SetDo()
+		} else {
+			q.SetEdns0(dnssecUDPSize, true)
+		}
+		next.ServeDNS(ctx, &responseWriterFunc{
+			ResponseWriter: w,
+			write: func(msg *dns.Msg) error {
+				msg.Answer = stripDNSSEC(msg.Answer, r.Question[0].Qtype)
+				msg.Ns = stripDNSSEC(msg.Ns, r.Question[0].Qtype)
+				extra := msg.Extra[:0]
+				for _, rr := range msg.Extra {
+					if o, ok := rr.(*dns.OPT); ok {
+						if opt == nil {
+							continue
+						}
+						o.SetDo(false)
+					}
+					if !isDNSSECType(rr.Header().Rrtype) {
+						extra = append(extra, rr)
+					}
+				}
+				msg.Extra = extra
+				return w.WriteMsg(msg)
+			},
+		}, q)
+	})
+}
+
+func stripDNSSEC(rrs []dns.RR, qtype uint16) []dns.RR {
+	kept := rrs[:0]
+	for _, rr := range rrs {
+		if rrtype := rr.Header().Rrtype; rrtype == qtype || !isDNSSECType(rrtype) {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,421 @@
+package dnsproxy
+
+import (
+	"context"
+	"crypto"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is a zone signed by a single key, or unsigned without key.
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+	rrs  []dns.RR
+}
+
+func newTestZone(t *testing.T, name string, signed bool, records ...string) *testZone {
+	z := &testZone{name: name}
+	if signed {
+		z.key = &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     257,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		priv, err := z.key.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.priv = priv.(crypto.Signer)
+		z.rrs = append(z.rrs, z.key)
+	}
+	apex := strings.TrimPrefix(name, ".")
+	records = append(records, name+" 3600 SOA ns."+apex+" admin."+apex+" 1 3600 600 86400 300")
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.rrs = append(z.rrs, rr)
+	}
+	return z
+}
+
+func (z *testZone) ds() string {
+	return z.key.ToDS(dns.SHA256).String()
+}
+
+func (z *testZone) sign(t *testing.T) {
+	if z.key == nil {
+		return
+	}
+	sets, _ := rrsets(z.rrs)
+	for _, set := range sets {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: set[0].Header().Ttl},
+			Algorithm:  z.key.Algorithm,
+			KeyTag:     z.key.KeyTag(),
+			SignerName: z.name,
+			Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+			Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		}
+		if err := sig.Sign(z.priv, set); err != nil {
+			t.Fatal(err)
+		}
+		z.rrs = append(z.rrs, sig)
+	}
+}
+
+// serve answers the query from the zone as a recursive dns server,
+// with the RRSIGs and the NSEC proofs.
+func (z *testZone) serve(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	msg := new(dns.Msg).SetReply(r)
+	msg.RecursionAvailable = true
+	msg.SetEdns0(dnssecUDPSize, true)
+
+	covered := func(rr dns.RR, rrtype uint16) bool {
+		sig, ok := rr.(*dns.RRSIG)
+		return ok && sig.TypeCovered == rrtype
+	}
+	owned := false
+	for _, rr := range z.rrs {
+		h := rr.Header()
+		if !strings.EqualFold(h.Name, q.Name) {
+			continue
+		}
+		owned = true
+		if h.Rrtype == q.Qtype || h.Rrtype == dns.TypeCNAME || covered(rr, q.Qtype) || covered(rr, dns.TypeCNAME) {
+			msg.Answer = append(msg.Answer, rr)
+		}
+	}
+	if len(msg.Answer) == 0 {
+		if !owned {
+			msg.Rcode = dns.RcodeNameError
+		}
+		var nsecs []string
+		wildcard := ""
+		for _, rr := range z.rrs {
+			if nsec, ok := rr.(*dns.NSEC); ok && (owned && strings.EqualFold(nsec.Hdr.Name, q.Name) ||
+				!owned && coverNSEC(nsec, q.Name)) {
+				nsecs = append(nsecs, nsec.Hdr.Name)
+				if !owned {
+					wildcard = "*." + encloserNSEC(nsec, q.Name)
+				}
+			}
+		}
+		// and the wildcard of the closest encloser does not exist
+		for _, rr := range z.rrs {
+			if nsec, ok := rr.(*dns.NSEC); ok && wildcard != "" && coverNSEC(nsec, wildcard) && nsec.Hdr.Name != nsecs[0] {
+				nsecs = append(nsecs, nsec.Hdr.Name)
+			}
+		}
+		for _, rr := range z.rrs {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeSOA || covered(rr, dns.TypeSOA) {
+				msg.Ns = append(msg.Ns, rr)
+			}
+			for _, name := range nsecs {
+				if h.Name == name && (h.Rrtype == dns.TypeNSEC || covered(rr, dns.TypeNSEC)) {
+					msg.Ns = append(msg.Ns, rr)
+				}
+			}
+		}
+	}
+	w.WriteMsg(msg)
+}
+
+// newTestDNSSECUpstream runs a recursive dns server of a signed root,
+// a signed example. and an unsigned insecure., and gets the trust anchor.
+func newTestDNSSECUpstream(t *testing.T) (string, string) {
+	example := newTestZone(t, "example.", true,
+		"example. 3600 NSEC bogus.example. SOA RRSIG NSEC DNSKEY",
+		"bogus.example. 3600 A 192.0.2.2",
+		"bogus.example. 3600 NSEC www.example. A RRSIG NSEC",
+		"www.example. 3600 A 192.0.2.1",
+		"www.example. 3600 NSEC example. A RRSIG NSEC")
+	example.sign(t)
+	// tamper the signed record
+	for _, rr := range example.rrs {
+		if a, ok := rr.(*dns.A); ok && a.Hdr.Name == "bogus.example." {
+			a.A[3] = 3
+		}
+	}
+
+	root := newTestZone(t, ".", true,
+		". 3600 NSEC example. SOA RRSIG NSEC DNSKEY",
+		example.ds(),
+		"example. 3600 NSEC insecure. NS DS RRSIG NSEC",
+		"insecure. 3600 NSEC . NS RRSIG NSEC")
+	root.sign(t)
+
+	insecure := newTestZone(t, "insecure.", false,
+		"www.insecure. 3600 A 192.0.2.3")
+
+	zones := []*testZone{example, insecure, root}
+	up := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		q := r.Question[0]
+		for _, z := range zones {
+			// DS is served by the parent zone
+			if dns.IsSubDomain(z.name, q.Name) && !(q.Qtype == dns.TypeDS && z.name == q.Name) {
+				z.serve(w, r)
+				return
+			}
+		}
+		root.serve(w, r)
+	})
+	return up, root.ds()
+}
+
+func TestDNSSEC(t *testing.T) {
+	up, anchor := newTestDNSSECUpstream(t)
+	p, err := NewProxy(&Config{
+		UpServers:    []string{up},
+		DNSSEC:       true,
+		TrustAnchors: []string{anchor},
+		WithCache:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	exchange := func(name string, do, cd bool) *dns.Msg {
+		m := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		m.CheckingDisabled = cd
+		if do {
+			m.SetEdns0(dnssecUDPSize, true)
+		}
+		r, err := p.Exchange(context.Background(), m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := exchange("www.example.", true, false)
+	if r.Rcode != dns.RcodeSuccess || !r.AuthenticatedData || len(r.Answer) != 2 {
+		t.Errorf("unexpected secure response: %v", r)
+	}
+
+	r = exchange("bogus.example.", false, false)
+	if r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("unexpected bogus response: %v", r)
+	}
+	r = exchange("bogus.example.", false, true)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Errorf("unexpected checking disabled response: %v", r)
+	}
+
+	r = exchange("www.insecure.", false, false)
+	if r.Rcode != dns.RcodeSuccess || r.AuthenticatedData || len(r.Answer) != 1 {
+		t.Errorf("unexpected insecure response: %v", r)
+	}
+
+	r = exchange("nope.example.", true, false)
+	if r.Rcode != dns.RcodeNameError || !r.AuthenticatedData {
+		t.Errorf("unexpected secure NXDOMAIN response: %v", r)
+	}
+
+	// the cached answer keeps its security state, without the DNSSEC RRs
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rec, ok := p.cache.Get(getQuetion(new(dns.Msg).SetQuestion("www.example.", dns.TypeA)))
+		if ok {
+			if rec.Security != SecuritySecure {
+				t.Errorf("cached the secure answer as %v", rec.Security)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the secure answer is not cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r = exchange("www.example.", false, false)
+	if !r.AuthenticatedData || len(r.Answer) != 1 || r.IsEdns0() != nil {
+		t.Errorf("unexpected cached response: %v", r)
+	}
+}
+
+func TestDNSSECInvalidKeys(t *testing.T) {
+	up, anchor := newTestDNSSECUpstream(t)
+	u, _ := ParseUpstream(up)
+	// the DS queries are refused without the question
+	v, err := newValidator([]string{anchor}, func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		if msg.Question[0].Qtype == dns.TypeDS {
+			r := new(dns.Msg).SetRcode(msg, dns.RcodeRefused)
+			r.Question = nil
+			return r, nil
+		}
+		return u.Exchange(ctx, msg)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := u.Exchange(context.Background(), newDNSSECQuery("www.example.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sec := v.validate(context.Background(), m); sec != SecurityBogus {
+		t.Errorf("validated the answer without the DS as %v", sec)
+	}
+}
+
+func TestDNSSECForwards(t *testing.T) {
+	up, anchor := newTestDNSSECUpstream(t)
+	corp := newTestUpstream(t, answerA("10.0.0.1"))
+	p, err := NewProxy(&Config{
+		UpServers:    []string{up},
+		Forwards:     map[string][]string{"corp.example.": {corp}},
+		DNSSEC:       true,
+		TrustAnchors: []string{anchor},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// the private zone under the signed parent is not validated
+	r, err := p.Exchange(context.Background(), new(dns.Msg).SetQuestion("www.corp.example.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeSuccess || r.AuthenticatedData || len(r.Answer) != 1 {
+		t.Errorf("unexpected forwarded response: %v", r)
+	}
+}
+
+func TestCanonicalCompare(t *testing.T) {
+	names := []string{".", "example.", "a.example.", "Z.a.example.", "zABC.a.EXAMPLE.", "z.example.", "*.z.example."}
+	for i := 1; i < len(names); i++ {
+		if canonicalCompare(names[i-1], names[i]) >= 0 {
+			t.Errorf("%s is not before %s", names[i-1], names[i])
+		}
+	}
+}
+
+// newTestNSEC3 creates the NSEC3 chain of the names with their types,
+// by SHA1 without iterations and salt.
+func newTestNSEC3(zone string, optOut bool, names map[string][]uint16) []dns.RR {
+	var hashes []string
+	types := make(map[string][]uint16)
+	for name, t := range names {
+		h := dns.HashName(name, dns.SHA1, 0, "")
+		hashes = append(hashes, h)
+		types[h] = t
+	}
+	sort.Strings(hashes)
+
+	var rrs []dns.RR
+	for i, h := range hashes {
+		rr := &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(h) + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 3600},
+			Hash:       dns.SHA1,
+			NextDomain: hashes[(i+1)%len(hashes)],
+			HashLength: 20,
+			TypeBitMap: types[h],
+		}
+		if optOut {
+			rr.Flags = 1
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+func TestDenial(t *testing.T) {
+	nsec := func(records ...string) []dns.RR {
+		var rrs []dns.RR
+		for _, s := range records {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rrs = append(rrs, rr)
+		}
+		return rrs
+	}
+	chain := map[string][]uint16{
+		"example.":     {dns.TypeNS, dns.TypeSOA, dns.TypeDNSKEY, dns.TypeNSEC3PARAM},
+		"a.example.":   {dns.TypeA},
+		"www.example.": {dns.TypeA},
+		"sub.example.": {dns.TypeNS, dns.TypeDS},
+	}
+	nsec3 := newTestNSEC3("example.", false, chain)
+	optOut := newTestNSEC3("example.", true, chain)
+	// without the NSEC3 matching the closest encloser
+	var noEncloser []dns.RR
+	apex := strings.ToLower(dns.HashName("example.", dns.SHA1, 0, ""))
+	for _, rr := range nsec3 {
+		if !strings.HasPrefix(rr.Header().Name, apex) {
+			noEncloser = append(noEncloser, rr)
+		}
+	}
+
+	for _, tt := range []struct {
+		desc  string
+		name  string
+		qtype uint16
+		rcode int
+		ns    []dns.RR
+		sec   Security
+	}{
+		{"nsec nxdomain", "nope.example.", dns.TypeA, dns.RcodeNameError, nsec(
+			"example. NSEC a.example. NS SOA RRSIG NSEC DNSKEY",
+			"a.example. NSEC www.example. A RRSIG NSEC"), SecuritySecure},
+		{"nsec forged wildcard denial", "nope.example.", dns.TypeA, dns.RcodeNameError, nsec(
+			"*.example. NSEC www.example. A RRSIG NSEC"), SecurityBogus},
+		{"nsec nxdomain without wildcard proof", "nope.example.", dns.TypeA, dns.RcodeNameError, nsec(
+			"a.example. NSEC www.example. A RRSIG NSEC"), SecurityBogus},
+		{"nsec nxdomain of empty non-terminal", "b.example.", dns.TypeA, dns.RcodeNameError, nsec(
+			"a.example. NSEC x.b.example. A RRSIG NSEC"), SecurityBogus},
+		{"nsec nodata", "www.example.", dns.TypeAAAA, dns.RcodeSuccess, nsec(
+			"www.example. NSEC example. A RRSIG NSEC"), SecuritySecure},
+		{"nsec nodata of existing type", "www.example.", dns.TypeA, dns.RcodeSuccess, nsec(
+			"www.example. NSEC example. A RRSIG NSEC"), SecurityBogus},
+		{"nsec nodata of empty non-terminal", "b.example.", dns.TypeA, dns.RcodeSuccess, nsec(
+			"a.example. NSEC x.b.example. A RRSIG NSEC"), SecuritySecure},
+		{"nsec wildcard nodata", "nope.example.", dns.TypeAAAA, dns.RcodeSuccess, nsec(
+			"a.example. NSEC www.example. A RRSIG NSEC",
+			"*.example. NSEC a.example. A RRSIG NSEC"), SecuritySecure},
+		{"nsec nodata of delegation", "sub.example.", dns.TypeA, dns.RcodeSuccess, nsec(
+			"sub.example. NSEC www.example. NS RRSIG NSEC"), SecurityBogus},
+		{"nsec ds nodata", "sub.example.", dns.TypeDS, dns.RcodeSuccess, nsec(
+			"sub.example. NSEC www.example. NS RRSIG NSEC"), SecuritySecure},
+		{"nsec ds nodata of zone apex", "sub.example.", dns.TypeDS, dns.RcodeSuccess, nsec(
+			"sub.example. NSEC www.sub.example. NS SOA RRSIG NSEC DNSKEY"), SecurityBogus},
+		{"nsec3 nxdomain", "nope.example.", dns.TypeA, dns.RcodeNameError, nsec3, SecuritySecure},
+		{"nsec3 nxdomain without closest encloser", "nope.example.", dns.TypeA, dns.RcodeNameError, noEncloser, SecurityBogus},
+		{"nsec3 nxdomain of existing name", "www.example.", dns.TypeA, dns.RcodeNameError, nsec3, SecurityBogus},
+		{"nsec3 nxdomain in opt-out span", "nope.example.", dns.TypeA, dns.RcodeNameError, optOut, SecurityInsecure},
+		{"nsec3 nodata", "www.example.", dns.TypeAAAA, dns.RcodeSuccess, nsec3, SecuritySecure},
+		{"nsec3 nodata without wildcard", "nope.example.", dns.TypeA, dns.RcodeSuccess, nsec3, SecurityBogus},
+		{"nsec3 ds nodata of delegation", "sub.example.", dns.TypeDS, dns.RcodeSuccess, nsec3, SecurityBogus},
+		{"nsec3 ds nodata in opt-out span", "unsigned.example.", dns.TypeDS, dns.RcodeSuccess, optOut, SecurityInsecure},
+		{"nsec3 ds nodata without opt-out", "unsigned.example.", dns.TypeDS, dns.RcodeSuccess, nsec3, SecurityBogus},
+	} {
+		msg := new(dns.Msg).SetQuestion(tt.name, tt.qtype)
+		msg.Rcode, msg.Ns = tt.rcode, tt.ns
+		if _, sec := denial(msg, tt.name, tt.qtype); sec != tt.sec {
+			t.Errorf("%s: got %v, expected %v", tt.desc, sec, tt.sec)
+		}
+	}
+
+	// the answer expanded from *.example.
+	if !wildcardProof(nsec("a.example. NSEC www.example. A RRSIG NSEC"), "nope.example.", 1) {
+		t.Error("the wildcard expansion is not proven by nsec")
+	}
+	if !wildcardProof(nsec3, "x.nope.example.", 1) {
+		t.Error("the wildcard expansion is not proven by nsec3")
+	}
+	if wildcardProof(nsec("www.example. NSEC example. A RRSIG NSEC"), "nope.example.", 1) {
+		t.Error("the wildcard expansion is proven by the unrelated nsec")
+	}
+}
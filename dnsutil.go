@@ -13,6 +13,25 @@ func IsSuccessfulResponse(msg *dns.Msg) bool {
 	return msg.Rcode == dns.RcodeSuccess
 }
 
+// IsNoDataResponse gets whether the msg is a successful response
+// without any answer and not a referral, aka NODATA. A SOA in the
+// authority marks it negative even with NS, as RFC 2308 type 1.
+func IsNoDataResponse(msg *dns.Msg) bool {
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Answer) > 0 {
+		return false
+	}
+	referral := false
+	for _, ns := range msg.Ns {
+		switch ns.Header().Rrtype {
+		case dns.TypeSOA:
+			return true
+		case dns.TypeNS:
+			referral = true
+		}
+	}
+	return !referral
+}
+
 // IsEmptyResponse gets whether the msg is an empty response
 // which has no answer, no ns and no extra
 func IsEmptyResponse(msg *dns.Msg) bool {
@@ -147,6 +166,28 @@ func NewResponse(rcode int) *dns.Msg {
 	return msg
 }
 
+// NewServerFailure creates a SERVFAIL response message for the query
+func NewServerFailure(query *dns.Msg) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetRcode(query, dns.RcodeServerFailure)
+	msg.RecursionAvailable = true
+	return msg
+}
+
+// isReplyTo gets whether the question of msg is the one of the query.
+func isReplyTo(query, msg *dns.Msg) bool {
+	if len(msg.Question) != 1 || len(query.Question) == 0 {
+		return false
+	}
+	q, mq := query.Question[0], msg.Question[0]
+	return q.Qtype == mq.Qtype && q.Qclass == mq.Qclass && strings.EqualFold(q.Name, mq.Name)
+}
+
 func getQuetion(msg *dns.Msg) string {
-	return strings.ToLower(dns.TypeToString[msg.Question[0].Qtype]) + "." + msg.Question[0].Name
+	return questionKey(msg.Question[0])
+}
+
+// questionKey gets the cache key of the question.
+func questionKey(q dns.Question) string {
+	return strings.ToLower(dns.TypeToString[q.Qtype]) + "." + q.Name
 }
@@ -0,0 +1,34 @@
+package dnsproxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestIsNoDataResponse(t *testing.T) {
+	soa, _ := dns.NewRR("example. 300 SOA ns.example. admin.example. 1 3600 600 86400 60")
+	ns, _ := dns.NewRR("example. 300 NS ns.example.")
+	a, _ := dns.NewRR("www.example. 300 A 192.0.2.1")
+	q := new(dns.Msg).SetQuestion("www.example.", dns.TypeAAAA)
+
+	for _, tt := range []struct {
+		rcode  int
+		answer []dns.RR
+		ns     []dns.RR
+		nodata bool
+	}{
+		{dns.RcodeSuccess, nil, nil, true},
+		{dns.RcodeSuccess, nil, []dns.RR{soa}, true},
+		{dns.RcodeSuccess, nil, []dns.RR{soa, ns}, true}, // RFC 2308 type 1
+		{dns.RcodeSuccess, nil, []dns.RR{ns}, false},     // referral
+		{dns.RcodeSuccess, []dns.RR{a}, nil, false},
+		{dns.RcodeNameError, nil, []dns.RR{soa}, false},
+	} {
+		msg := new(dns.Msg).SetRcode(q, tt.rcode)
+		msg.Answer, msg.Ns = tt.answer, tt.ns
+		if got := IsNoDataResponse(msg); got != tt.nodata {
+			t.Errorf("IsNoDataResponse(%v) = %v, expected %v", msg, got, tt.nodata)
+		}
+	}
+}
@@ -10,4 +10,14 @@ var (
 	ErrUnexpectedResp  = errors.New("Unexpected Response")
 	ErrHugePacket      = errors.New("Huge Packet")
 	ErrCyclicCNAME     = errors.New("Maybe cyclic CNAME")
+	ErrInvalidConfig   = errors.New("Invalid Config")
+	ErrServerClosed    = errors.New("Server Closed")
+	ErrInvalidUpstream = errors.New("Invalid Upstream")
+	ErrInvalidCA       = errors.New("Invalid CA")
+	ErrPinMismatch     = errors.New("SPKI Pin Mismatch")
+	ErrWritten         = errors.New("Response Written")
+	ErrInvalidQuery    = errors.New("Invalid Query")
+	ErrNoResponse      = errors.New("No Response")
+	ErrInvalidStrategy = errors.New("Invalid Strategy")
+	ErrBogus           = errors.New("DNSSEC Bogus")
 )
@@ -0,0 +1,61 @@
+package dnsproxy
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// setForwards builds the up server groups of the forwarding rules,
+// which are matched by the longest domain suffix of the query name.
+func (p *Proxy) setForwards() error {
+	domains := make([]string, 0, len(p.config.Forwards))
+	for domain := range p.config.Forwards {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	for _, domain := range domains {
+		servers := p.config.Forwards[domain]
+		ups, err := ParseUpstreams(servers)
+		if err != nil {
+			return err
+		}
+		p.owned = append(p.owned, ups...)
+		if len(ups) == 0 {
+			return ErrInvalidConfig
+		}
+
+		weights := make([]int, len(servers))
+		for i, s := range servers {
+			weights[i] = p.config.Weights[s]
+		}
+		g, err := p.newGroup(ups, weights)
+		if err != nil {
+			return err
+		}
+		if p.forwards == nil {
+			p.forwards = NewTrie()
+		}
+		p.forwards.Insert(canonicalName(domain), g)
+	}
+	return nil
+}
+
+// forwardOf gets the up servers of the longest matched forwarding rule
+// of name.
+func (p *Proxy) forwardOf(name string) (*upstreamGroup, bool) {
+	if p.forwards == nil {
+		return nil, false
+	}
+	v, ok := p.forwards.Match(canonicalName(name))
+	if !ok {
+		return nil, false
+	}
+	return v.(*upstreamGroup), true
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
@@ -0,0 +1,84 @@
+package dnsproxy
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestForwards(t *testing.T) {
+	public := newTestUpstream(t, answerA("192.0.2.1"))
+	corp := newTestUpstream(t, answerA("10.0.0.1"))
+	dev := newTestUpstream(t, answerA("10.0.1.1"))
+	p, err := NewProxy(&Config{
+		UpServers: []string{public},
+		Forwards: map[string][]string{
+			"corp.example":      {corp},
+			"dev.corp.example.": {dev},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for name, expected := range map[string]string{
+		"www.example.":          "192.0.2.1",
+		"corp.example.":         "10.0.0.1",
+		"WWW.Corp.Example.":     "10.0.0.1",
+		"www.dev.corp.example.": "10.0.1.1",
+		"www.xcorp.example.":    "192.0.2.1",
+	} {
+		m := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		r, err := p.Exchange(context.Background(), m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != expected {
+			t.Errorf("unexpected response of %s: %v, expected: %s", name, r, expected)
+		}
+	}
+
+	if n := len(p.UpstreamHealth()); n != 3 {
+		t.Errorf("got the health of %d up servers, expected 3", n)
+	}
+}
+
+func TestForwardReferral(t *testing.T) {
+	var queries int32
+	public := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		answerA("192.0.2.1")(w, r)
+	})
+	corp := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg).SetReply(r)
+		ns, _ := dns.NewRR("sub.corp.example. 60 NS ns.sub.corp.example.")
+		glue, _ := dns.NewRR("ns.sub.corp.example. 60 A 10.0.0.53")
+		msg.Ns = append(msg.Ns, ns)
+		msg.Extra = append(msg.Extra, glue)
+		w.WriteMsg(msg)
+	})
+	p, err := NewProxy(&Config{
+		UpServers: []string{public},
+		Forwards:  map[string][]string{"corp.example.": {corp}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// the referral of the forward target is responded as is
+	m := new(dns.Msg).SetQuestion("www.sub.corp.example.", dns.TypeA)
+	r, err := p.Exchange(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 || len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeNS {
+		t.Errorf("unexpected response: %v", r)
+	}
+	if n := atomic.LoadInt32(&queries); n != 0 {
+		t.Errorf("the forwarded name is sent to the default up server %d times", n)
+	}
+}
@@ -0,0 +1,54 @@
+package dnsproxy
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ResponseWriter writes the response of a dns query,
+// dns.ResponseWriter satisfies it.
+type ResponseWriter interface {
+	// RemoteAddr gets the client's address
+	RemoteAddr() net.Addr
+	// WriteMsg writes the response to the client
+	WriteMsg(*dns.Msg) error
+}
+
+// Handler responds to a dns query. The query is dropped if the handler
+// writes no response.
+type Handler interface {
+	ServeDNS(ctx context.Context, w ResponseWriter, r *dns.Msg)
+}
+
+// HandlerFunc is an adapter to use a function as Handler.
+type HandlerFunc func(ctx context.Context, w ResponseWriter, r *dns.Msg)
+
+// ServeDNS calls f(ctx, w, r).
+func (f HandlerFunc) ServeDNS(ctx context.Context, w ResponseWriter, r *dns.Msg) {
+	f(ctx, w, r)
+}
+
+// Middleware wraps the next handler, it may respond to the query itself,
+// modify the query or the response, or pass the query to the next.
+type Middleware func(next Handler) Handler
+
+// Chain chains the middlewares around h, the first middleware is the
+// outermost one.
+func Chain(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// responseWriterFunc is a ResponseWriter intercepting the response.
+type responseWriterFunc struct {
+	ResponseWriter
+	write func(*dns.Msg) error
+}
+
+func (w *responseWriterFunc) WriteMsg(msg *dns.Msg) error {
+	return w.write(msg)
+}
@@ -0,0 +1,84 @@
+package dnsproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMiddlewares(t *testing.T) {
+	up := newTestUpstream(t, answerA("192.0.2.1"))
+
+	var mu sync.Mutex
+	clients := make(map[string]string) // the remote address by the query name
+	logging := func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *dns.Msg) {
+			if addr := w.RemoteAddr(); addr != nil {
+				mu.Lock()
+				clients[r.Question[0].Name] = addr.String()
+				mu.Unlock()
+			}
+			next.ServeDNS(ctx, w, r)
+		})
+	}
+	blocking := func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *dns.Msg) {
+			if r.Question[0].Name == "blocked.example." {
+				w.WriteMsg(new(dns.Msg).SetRcode(r, dns.RcodeNameError))
+				return
+			}
+			next.ServeDNS(ctx, w, r)
+		})
+	}
+	_, pool, cert := newTestCACert(t, "dns.example")
+	certFile, keyFile := writeTestCert(t, t.TempDir(), cert)
+	s := newTestServer(t, &Config{
+		UpServers:   []string{up},
+		WithCache:   true,
+		Middlewares: []Middleware{logging, blocking},
+		TLSAddr:     "127.0.0.1:0",
+		CertFile:    certFile,
+		KeyFile:     keyFile,
+	})
+
+	c := new(dns.Client)
+	r, _, err := c.Exchange(new(dns.Msg).SetQuestion("blocked.example.", dns.TypeA), s.Addr().String())
+	if err != nil || r.Rcode != dns.RcodeNameError {
+		t.Errorf("failed to block: %v, err: %v", r, err)
+	}
+	r, _, err = c.Exchange(new(dns.Msg).SetQuestion("www.example.", dns.TypeA), s.Addr().String())
+	if err != nil || len(r.Answer) != 1 {
+		t.Errorf("failed to pass through: %v, err: %v", r, err)
+	}
+
+	// the remote addresses of the queries over tcp and tls
+	for _, tt := range []struct {
+		name string
+		c    *dns.Client
+		addr string
+	}{
+		{"tcp.example.", &dns.Client{Net: "tcp"}, s.Addr().String()},
+		{"tls.example.", &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{ServerName: "dns.example", RootCAs: pool}}, s.dlisten.Addr().String()},
+	} {
+		conn, err := tt.c.Dial(tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, _, err = tt.c.ExchangeWithConn(new(dns.Msg).SetQuestion(tt.name, dns.TypeA), conn)
+		if err != nil || len(r.Answer) != 1 {
+			t.Errorf("failed to resolve %s: %v, err: %v", tt.name, r, err)
+		}
+		mu.Lock()
+		if addr := clients[tt.name]; addr != conn.LocalAddr().String() {
+			t.Errorf("got the remote address %q of %s, expected %s", addr, tt.name, conn.LocalAddr())
+		}
+		mu.Unlock()
+		conn.Close()
+	}
+	if len(clients) != 4 {
+		t.Errorf("logged %d queries, expected 4", len(clients))
+	}
+}
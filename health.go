@@ -0,0 +1,204 @@
+package dnsproxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	failThreshold = 3 // consecutive failures to mark an up server down
+
+	minBackoff = time.Second
+	maxBackoff = time.Minute * 5
+
+	defaultHealthInterval = time.Second * 10
+)
+
+// UpstreamHealth is the health state of an up dns server.
+type UpstreamHealth struct {
+	Upstream string
+	Healthy  bool
+	Failures int           // consecutive failures
+	RetryAt  time.Time     // when to retry the down up server
+	RTT      time.Duration // EWMA rtt
+}
+
+// health is the circuit breaker of an up dns server, fed by the failures
+// of the queries and the probes. The up server is marked down after
+// failThreshold consecutive failures, and retried with exponential backoff.
+type health struct {
+	mu       sync.Mutex
+	failures int
+	down     bool
+	trial    bool // a query is trying the down up server, aka half-open
+	backoff  time.Duration
+	retryAt  time.Time
+}
+
+// available gets whether to send queries to the up server. A down up
+// server is brought back by the probes, or retried by a query after the
+// backoff if there are no probes.
+func (u *upstreamStat) available(probing bool) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !u.down || !probing && !u.trial && time.Now().After(u.retryAt)
+}
+
+// try gets whether to send the query to the available up server. Only one
+// query at a time tries the down up server, the others are sent to the
+// healthy ones until the trial succeeds or fails.
+func (u *upstreamStat) try(probing bool) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.down {
+		return true
+	}
+	if probing || u.trial || time.Now().Before(u.retryAt) {
+		return false
+	}
+	u.trial = true
+	return true
+}
+
+// endTrial ends the trial of the down up server without the result,
+// e.g. the query is canceled.
+func (u *upstreamStat) endTrial() {
+	u.mu.Lock()
+	u.trial = false
+	u.mu.Unlock()
+}
+
+func (u *upstreamStat) retryable() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !u.down || time.Now().After(u.retryAt)
+}
+
+func (u *upstreamStat) recordSuccess() {
+	u.mu.Lock()
+	u.failures = 0
+	up := u.down
+	u.down, u.trial, u.backoff = false, false, 0
+	u.mu.Unlock()
+
+	if up {
+		u.group.logf("dnsproxy: upstream %s is up", u.name())
+	}
+}
+
+func (u *upstreamStat) recordFailure(err error) {
+	u.mu.Lock()
+	u.failures++
+	u.trial = false
+	down := false
+	switch {
+	case u.down:
+		u.backoff *= 2
+		if u.backoff > maxBackoff {
+			u.backoff = maxBackoff
+		}
+		u.retryAt = time.Now().Add(u.backoff)
+	case u.failures >= failThreshold:
+		u.down, down = true, true
+		u.backoff = minBackoff
+		u.retryAt = time.Now().Add(u.backoff)
+	}
+	backoff := u.backoff
+	u.mu.Unlock()
+
+	if down {
+		u.group.logf("dnsproxy: upstream %s is down, retry after %v, err: %v", u.name(), backoff, err)
+	}
+}
+
+func (u *upstreamStat) state() UpstreamHealth {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return UpstreamHealth{
+		Upstream: u.name(),
+		Healthy:  !u.down,
+		Failures: u.failures,
+		RetryAt:  u.retryAt,
+		RTT:      time.Duration(atomic.LoadInt64(&u.rtt)),
+	}
+}
+
+func (u *upstreamStat) name() string {
+	if s, ok := u.Upstream.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", u.Upstream)
+}
+
+func (g *upstreamGroup) logf(format string, args ...interface{}) {
+	if g.logger != nil {
+		g.logger.Printf(format, args...)
+	}
+}
+
+// health gets the health states of the up servers.
+func (g *upstreamGroup) health() []UpstreamHealth {
+	hs := make([]UpstreamHealth, len(g.ups))
+	for i, u := range g.ups {
+		hs[i] = u.state()
+	}
+	return hs
+}
+
+// probe probes the up servers with the query every interval,
+// the down ones are probed after their backoff.
+func (g *upstreamGroup) probe(query *dns.Msg, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		var wg sync.WaitGroup
+		for _, u := range g.ups {
+			if !u.retryable() {
+				continue
+			}
+			wg.Add(1)
+			go func(u *upstreamStat) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), wait)
+				defer cancel()
+				q := query.Copy()
+				q.Id = dns.Id()
+				if _, err := u.Exchange(ctx, q); err != nil {
+					u.recordFailure(err)
+				} else {
+					u.recordSuccess()
+				}
+			}(u)
+		}
+		wg.Wait()
+	}
+}
+
+// parseProbe parses the probe query like "example.com. A",
+// the type is A by default.
+func parseProbe(probe string) (*dns.Msg, error) {
+	fields := strings.Fields(probe)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, ErrInvalidConfig
+	}
+	qtype := dns.TypeA
+	if len(fields) == 2 {
+		var ok bool
+		if qtype, ok = dns.StringToType[strings.ToUpper(fields[1])]; !ok {
+			return nil, ErrInvalidConfig
+		}
+	}
+	return new(dns.Msg).SetQuestion(dns.Fqdn(fields[0]), qtype), nil
+}
@@ -0,0 +1,87 @@
+package dnsproxy
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHealth(t *testing.T) {
+	m := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+	ctx := context.Background()
+
+	bad, good := &fakeUpstream{failing: 1}, &fakeUpstream{}
+	g := testGroup(t, StrategySequential, nil, bad, good)
+	g.probing = true
+	for i := 0; i < failThreshold+2; i++ {
+		if _, err := g.exchange(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&bad.queries); n != failThreshold {
+		t.Errorf("queried the down upstream %d times, expected %d", n, failThreshold)
+	}
+	if hs := g.health(); hs[0].Healthy || !hs[1].Healthy {
+		t.Errorf("unexpected health: %+v", hs)
+	}
+
+	// bring it back by the probes
+	atomic.StoreInt32(&bad.failing, 0)
+	g.ups[0].mu.Lock()
+	g.ups[0].retryAt = time.Now()
+	g.ups[0].mu.Unlock()
+	done := make(chan struct{})
+	defer close(done)
+	go g.probe(m, 10*time.Millisecond, done)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !g.health()[0].Healthy {
+		if time.Now().After(deadline) {
+			t.Fatal("the upstream is not brought back by the probes")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHealthTrial(t *testing.T) {
+	m := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+	bad := &fakeUpstream{delay: 100 * time.Millisecond, failing: 1}
+	good := &fakeUpstream{}
+	g := testGroup(t, StrategySequential, nil, bad, good)
+	g.ups[0].mu.Lock()
+	g.ups[0].failures, g.ups[0].down = failThreshold, true
+	g.ups[0].backoff, g.ups[0].retryAt = minBackoff, time.Now()
+	g.ups[0].mu.Unlock()
+
+	// only one query tries the down upstream after the backoff
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r, err := g.exchange(context.Background(), m); err != nil || r.Rcode != dns.RcodeSuccess {
+				t.Errorf("unexpected response: %v, err: %v", r, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&bad.queries); n != 1 {
+		t.Errorf("queried the down upstream %d times, expected 1", n)
+	}
+	if hs := g.health(); hs[0].Healthy || !hs[0].RetryAt.After(time.Now()) {
+		t.Errorf("the failed trial does not back off: %+v", hs[0])
+	}
+}
+
+func TestParseProbe(t *testing.T) {
+	if m, err := parseProbe("example.com AAAA"); err != nil || m.Question[0].Name != "example.com." || m.Question[0].Qtype != dns.TypeAAAA {
+		t.Errorf("parsed probe: %v, err: %v", m, err)
+	}
+	if _, err := parseProbe("example.com XYZ"); err == nil {
+		t.Error("parsed invalid probe type")
+	}
+}
@@ -0,0 +1,443 @@
+package dnsproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultRootHints are the root servers of named.root.
+const defaultRootHints = `
+.                   3600000 NS A.ROOT-SERVERS.NET.
+.                   3600000 NS B.ROOT-SERVERS.NET.
+.                   3600000 NS C.ROOT-SERVERS.NET.
+.                   3600000 NS D.ROOT-SERVERS.NET.
+.                   3600000 NS E.ROOT-SERVERS.NET.
+.                   3600000 NS F.ROOT-SERVERS.NET.
+.                   3600000 NS G.ROOT-SERVERS.NET.
+.                   3600000 NS H.ROOT-SERVERS.NET.
+.                   3600000 NS I.ROOT-SERVERS.NET.
+.                   3600000 NS J.ROOT-SERVERS.NET.
+.                   3600000 NS K.ROOT-SERVERS.NET.
+.                   3600000 NS L.ROOT-SERVERS.NET.
+.                   3600000 NS M.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET. 3600000 A  198.41.0.4
+B.ROOT-SERVERS.NET. 3600000 A  170.247.170.2
+C.ROOT-SERVERS.NET. 3600000 A  192.33.4.12
+D.ROOT-SERVERS.NET. 3600000 A  199.7.91.13
+E.ROOT-SERVERS.NET. 3600000 A  192.203.230.10
+F.ROOT-SERVERS.NET. 3600000 A  192.5.5.241
+G.ROOT-SERVERS.NET. 3600000 A  192.112.36.4
+H.ROOT-SERVERS.NET. 3600000 A  198.97.190.53
+I.ROOT-SERVERS.NET. 3600000 A  192.36.148.17
+J.ROOT-SERVERS.NET. 3600000 A  192.58.128.30
+K.ROOT-SERVERS.NET. 3600000 A  193.0.14.129
+L.ROOT-SERVERS.NET. 3600000 A  199.7.83.42
+M.ROOT-SERVERS.NET. 3600000 A  202.12.27.33
+`
+
+const (
+	maxReferrals = 16 // referrals to follow for a name
+	maxGlueDepth = 4  // nested resolving of the glueless name servers
+	maxQueries   = 64 // queries to the name servers for a query
+
+	maxZoneCuts = 10000 // cached zone cuts, the least recently used evicted
+
+	iterUDPSize = 1232 // EDNS0 udp size of the queries to the name servers
+)
+
+// iterator resolves the queries iteratively from the root servers,
+// and caches the zone cuts.
+type iterator struct {
+	root  *delegation // of the root hints, never expired
+	zones *Trie       // zone name to *Record of the referral and its cut
+	port  string      // port of the name servers
+}
+
+// delegation is a zone cut with its name servers.
+type delegation struct {
+	zone string
+
+	mu      sync.Mutex // guards the addresses of the glueless name servers
+	servers []*nameserver
+}
+
+type nameserver struct {
+	name  string
+	addrs []string // the glue, or resolved for the glueless name server
+}
+
+// newIterator creates an iterator with the root hints file,
+// or the built-in root servers if hints is empty.
+func newIterator(hints string) (*iterator, error) {
+	var r io.Reader = strings.NewReader(defaultRootHints)
+	if hints != "" {
+		f, err := os.Open(hints)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	root, err := parseRootHints(r, hints)
+	if err != nil {
+		return nil, err
+	}
+	return &iterator{root: root, zones: NewBoundedTrie(maxZoneCuts, 0), port: "53"}, nil
+}
+
+// parseRootHints parses the root servers in the format of named.root.
+func parseRootHints(r io.Reader, file string) (*delegation, error) {
+	var names []string
+	addrs := make(map[string][]string)
+	zp := dns.NewZoneParser(r, ".", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr := rr.(type) {
+		case *dns.NS:
+			if rr.Hdr.Name == "." {
+				names = append(names, canonicalName(rr.Ns))
+			}
+		case *dns.A:
+			name := canonicalName(rr.Hdr.Name)
+			addrs[name] = append(addrs[name], rr.A.String())
+		case *dns.AAAA:
+			name := canonicalName(rr.Hdr.Name)
+			addrs[name] = append(addrs[name], rr.AAAA.String())
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	root := &delegation{zone: "."}
+	for _, name := range names {
+		if len(addrs[name]) != 0 {
+			root.servers = append(root.servers, &nameserver{name: name, addrs: addrs[name]})
+		}
+	}
+	if len(root.servers) == 0 {
+		return nil, fmt.Errorf("%w: no root servers in the root hints %s", ErrInvalidConfig, file)
+	}
+	return root, nil
+}
+
+func (it *iterator) newResolver(ctx context.Context) iresolver {
+	return &iteration{
+		resolver: &resolver{ctx: ctx, ts: time.Now()},
+		iterator: it,
+	}
+}
+
+// closest gets the closest cached zone cut of name, or the root. The
+// expired cuts are removed by Get.
+func (it *iterator) closest(name string) *delegation {
+	for {
+		v, ok := it.zones.Match(name)
+		if !ok {
+			return it.root
+		}
+		if r, ok := it.zones.Get(v.(*Record).key); ok {
+			return r.data.(*delegation)
+		}
+	}
+}
+
+func (d *delegation) nameservers() []nameserver {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	servers := make([]nameserver, len(d.servers))
+	for i, ns := range d.servers {
+		servers[i] = *ns
+	}
+	return servers
+}
+
+func (d *delegation) setAddrs(name string, addrs []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, ns := range d.servers {
+		if ns.name == name {
+			ns.addrs = addrs
+		}
+	}
+}
+
+// iteration is the state of resolving a query iteratively.
+type iteration struct {
+	*resolver
+	*iterator
+
+	queries int
+	do      bool // whether to query with DO
+}
+
+func (st *iteration) resolve(msg *dns.Msg) (*dns.Msg, error) {
+	q := msg.Question[0]
+	if opt := msg.IsEdns0(); opt != nil {
+		st.do = opt.Do()
+	}
+	m, err := st.resolveName(q.Name, q.Qtype, q.Qclass, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := new(dns.Msg).SetRcode(msg, m.Rcode)
+	reply.RecursionAvailable = true
+	reply.Answer, reply.Ns = m.Answer, m.Ns
+	return reply, nil
+}
+
+// resolveName resolves name and chases the CNAMEs,
+// depth is the nesting of resolving the glueless name servers.
+func (st *iteration) resolveName(name string, qtype, qclass uint16, depth int) (*dns.Msg, error) {
+	name = canonicalName(name)
+	var answers []dns.RR
+	for cnames := 0; cnames < cnameLimit; cnames++ {
+		m, zone, err := st.lookup(name, qtype, qclass, depth)
+		if err != nil {
+			return nil, err
+		}
+		rrs, target, err := chase(m.Answer, name, qtype, zone)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, rrs...)
+		if target == "" {
+			m.Answer = answers
+			return m, nil
+		}
+		name = target
+	}
+	return nil, ErrCyclicCNAME
+}
+
+// chase gets the RRs of name and their RRSIGs in the answers by following
+// the CNAMEs, and the target to resolve if the CNAMEs lead out of the answers
+// or out of the bailiwick of zone, whose name servers respond the answers.
+func chase(answers []dns.RR, name string, qtype uint16, zone string) ([]dns.RR, string, error) {
+	var rrs []dns.RR
+	for i := 0; i < cnameLimit; i++ {
+		if i > 0 && !dns.IsSubDomain(zone, name) {
+			// not trusted from the name servers of zone
+			return rrs, name, nil
+		}
+		var target string
+		owned, found := false, false
+		for _, rr := range answers {
+			h := rr.Header()
+			if !strings.EqualFold(h.Name, name) {
+				continue
+			}
+			owned = true
+			if sig, ok := rr.(*dns.RRSIG); ok && qtype != dns.TypeRRSIG {
+				if sig.TypeCovered == qtype || sig.TypeCovered == dns.TypeCNAME {
+					rrs = append(rrs, rr)
+				}
+				continue
+			}
+			if cname, ok := rr.(*dns.CNAME); ok && qtype != dns.TypeCNAME {
+				if target == "" {
+					rrs = append(rrs, rr)
+					target = canonicalName(cname.Target)
+				}
+				continue
+			}
+			if h.Rrtype == qtype || qtype == dns.TypeANY {
+				rrs = append(rrs, rr)
+				found = true
+			}
+		}
+		if i > 0 && !owned {
+			return rrs, name, nil
+		}
+		if found || target == "" {
+			return rrs, "", nil
+		}
+		name = target
+	}
+	return nil, "", ErrCyclicCNAME
+}
+
+// lookup queries name from its closest zone cut, and follows the referrals.
+// It gets the response and the zone of the name servers responding it.
+func (st *iteration) lookup(name string, qtype, qclass uint16, depth int) (*dns.Msg, string, error) {
+	cut := st.closest(name)
+	for i := 0; i < maxReferrals; i++ {
+		m, err := st.query(cut, name, qtype, qclass, depth)
+		if err != nil {
+			return nil, "", err
+		}
+
+		next, ok := st.referral(cut, name, m)
+		if !ok {
+			return m, cut.zone, nil
+		}
+		cut = next
+	}
+	return nil, "", ErrServerFailed
+}
+
+// isChild gets whether zone is a child zone of the cut, which contains name.
+func (d *delegation) isChild(zone, name string) bool {
+	return zone != d.zone && dns.IsSubDomain(d.zone, zone) && dns.IsSubDomain(zone, name)
+}
+
+// isLame gets whether the response of the cut's name server is neither an
+// answer nor a referral to a child zone, e.g. an upward referral.
+func (d *delegation) isLame(name string, m *dns.Msg) bool {
+	if m.Authoritative || !IsSuccessfulResponse(m) || len(m.Answer) != 0 {
+		return false
+	}
+	for _, rr := range m.Ns {
+		if ns, ok := rr.(*dns.NS); ok && d.isChild(canonicalName(ns.Hdr.Name), name) {
+			return false
+		}
+	}
+	return true
+}
+
+// referral gets the child zone cut from the referral of the cut's name
+// server. The child zone must be under the cut and contain name, and
+// only the glue in the cut's bailiwick is accepted.
+func (st *iteration) referral(cut *delegation, name string, m *dns.Msg) (*delegation, bool) {
+	if !IsSuccessfulResponse(m) || len(m.Answer) != 0 {
+		return nil, false
+	}
+
+	var d *delegation
+	var ttl uint32
+	for _, rr := range m.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		zone := canonicalName(ns.Hdr.Name)
+		if !cut.isChild(zone, name) {
+			continue
+		}
+		if d == nil {
+			d, ttl = &delegation{zone: zone}, ns.Hdr.Ttl
+		} else if zone != d.zone {
+			continue
+		}
+		if ns.Hdr.Ttl < ttl {
+			ttl = ns.Hdr.Ttl
+		}
+		d.servers = append(d.servers, &nameserver{name: canonicalName(ns.Ns)})
+	}
+	if d == nil {
+		return nil, false
+	}
+
+	// the ipv4 glue first
+	for _, rrtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		for _, rr := range m.Extra {
+			owner := canonicalName(rr.Header().Name)
+			if rr.Header().Rrtype != rrtype || !dns.IsSubDomain(cut.zone, owner) {
+				continue
+			}
+			var addr string
+			switch rr := rr.(type) {
+			case *dns.A:
+				addr = rr.A.String()
+			case *dns.AAAA:
+				addr = rr.AAAA.String()
+			}
+			for _, ns := range d.servers {
+				if ns.name == owner {
+					ns.addrs = append(ns.addrs, addr)
+				}
+			}
+		}
+	}
+
+	now := time.Now()
+	st.zones.Add(d.zone, &Record{
+		Stored:  now,
+		Expired: now.Add(time.Duration(ttl) * time.Second),
+		Msg:     m,
+		data:    d,
+	})
+	return d, true
+}
+
+// query queries name from the name servers of the cut in order,
+// and takes the first answer, NXDOMAIN or referral, skipping the lame
+// name servers.
+func (st *iteration) query(cut *delegation, name string, qtype, qclass uint16, depth int) (*dns.Msg, error) {
+	q := new(dns.Msg).SetQuestion(name, qtype)
+	q.Question[0].Qclass = qclass
+	q.RecursionDesired = false
+	q.SetEdns0(iterUDPSize, st.do)
+
+	err := ErrServerFailed
+	for _, ns := range cut.nameservers() {
+		addrs := ns.addrs
+		if len(addrs) == 0 {
+			if addrs, err = st.resolveNS(cut, ns.name, depth); err != nil {
+				continue
+			}
+		}
+
+		for _, addr := range addrs {
+			if st.ctx.Err() != nil {
+				return nil, st.ctx.Err()
+			}
+			if st.queries++; st.queries > maxQueries {
+				return nil, ErrServerFailed
+			}
+
+			var m *dns.Msg
+			u := newPlainUpstream("udp", net.JoinHostPort(addr, st.port))
+			if m, err = st.exchange(u, q); err != nil {
+				continue
+			}
+			if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError || cut.isLame(name, m) {
+				err = ErrServerFailed
+				continue
+			}
+			return m, nil
+		}
+	}
+	return nil, err
+}
+
+// resolveNS resolves the addresses of the glueless name server,
+// which are kept in the cut.
+func (st *iteration) resolveNS(cut *delegation, name string, depth int) ([]string, error) {
+	if depth >= maxGlueDepth {
+		return nil, ErrServerFailed
+	}
+
+	var addrs []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m, err := st.resolveName(name, qtype, dns.ClassINET, depth+1)
+		if err != nil {
+			continue
+		}
+		for _, rr := range m.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, rr.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA.String())
+			}
+		}
+		if len(addrs) != 0 {
+			break
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, ErrNotFound
+	}
+	cut.setAddrs(name, addrs)
+	return addrs, nil
+}
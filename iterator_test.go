@@ -0,0 +1,240 @@
+package dnsproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newTestAuth runs an authoritative dns server of the zone on ip:port,
+// which refers the queries under the delegated zones in records, follows
+// the CNAMEs in records, and counts the queries.
+func newTestAuth(t *testing.T, ip, port, zone string, records ...string) *int32 {
+	var rrs []dns.RR
+	var soa dns.RR
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rr.Header().Rrtype == dns.TypeSOA {
+			soa = rr
+		}
+		rrs = append(rrs, rr)
+	}
+
+	queries := new(int32)
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		q := r.Question[0]
+		msg := new(dns.Msg).SetReply(r)
+
+		// referral
+		for _, rr := range rrs {
+			ns, ok := rr.(*dns.NS)
+			if ok && ns.Hdr.Name != zone && dns.IsSubDomain(ns.Hdr.Name, q.Name) {
+				msg.Ns = append(msg.Ns, rr)
+				for _, glue := range rrs {
+					if glue.Header().Rrtype == dns.TypeA && glue.Header().Name == ns.Ns {
+						msg.Extra = append(msg.Extra, glue)
+					}
+				}
+			}
+		}
+		if len(msg.Ns) != 0 {
+			w.WriteMsg(msg)
+			return
+		}
+
+		msg.Authoritative = true
+		owned := false
+		for name := q.Name; name != ""; {
+			target := ""
+			for _, rr := range rrs {
+				if !strings.EqualFold(rr.Header().Name, name) {
+					continue
+				}
+				owned = true
+				if rr.Header().Rrtype == q.Qtype {
+					msg.Answer = append(msg.Answer, rr)
+				} else if cname, ok := rr.(*dns.CNAME); ok {
+					msg.Answer = append(msg.Answer, rr)
+					target = cname.Target
+				}
+			}
+			name = target
+		}
+		if len(msg.Answer) == 0 {
+			if !owned {
+				msg.Rcode = dns.RcodeNameError
+			}
+			msg.Ns = append(msg.Ns, soa)
+		}
+		w.WriteMsg(msg)
+	}
+
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(ip, port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(handler)}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return queries
+}
+
+func TestIterator(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	pc.Close()
+
+	roots := newTestAuth(t, "127.0.0.1", port, ".",
+		". 60 SOA a.root-servers.test. admin. 1 3600 600 86400 60",
+		"example. 60 NS lame.example.",
+		"example. 60 NS ns.example.",
+		"lame.example. 60 A 127.0.0.5",
+		"ns.example. 60 A 127.0.0.2",
+		"net. 60 NS ns.net.",
+		"ns.net. 60 A 127.0.0.3")
+	newTestAuth(t, "127.0.0.2", port, "example.",
+		"example. 60 SOA ns.example. admin.example. 1 3600 600 86400 60",
+		"www.example. 60 CNAME www.corp.example.",
+		"mail.example. 60 CNAME mail.net.",
+		"mail.net. 60 A 192.0.2.66", // out of bailiwick
+		"corp.example. 60 NS ns.corp.net.",
+		"ns.corp.net. 60 A 127.0.0.9") // out of bailiwick
+	// a lame name server of example. refers upward to the root
+	newTestAuth(t, "127.0.0.5", port, "example.",
+		". 60 NS a.root-servers.test.",
+		"a.root-servers.test. 60 A 127.0.0.1")
+	newTestAuth(t, "127.0.0.3", port, "net.",
+		"net. 60 SOA ns.net. admin.net. 1 3600 600 86400 60",
+		"ns.corp.net. 60 A 127.0.0.4",
+		"mail.net. 60 A 192.0.2.20")
+	newTestAuth(t, "127.0.0.4", port, "corp.example.",
+		"corp.example. 60 SOA ns.corp.net. admin.corp.example. 1 3600 600 86400 60",
+		"www.corp.example. 60 A 192.0.2.10",
+		"txt.corp.example. 60 TXT hello")
+
+	hints := filepath.Join(t.TempDir(), "named.root")
+	err = os.WriteFile(hints, []byte(". 3600000 NS a.root-servers.test.\na.root-servers.test. 3600000 A 127.0.0.1\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewProxy(&Config{Recursive: true, RootHints: hints})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.iterator.port = port
+
+	exchange := func(name string, qtype uint16) *dns.Msg {
+		r, err := p.Exchange(context.Background(), new(dns.Msg).SetQuestion(name, qtype))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := exchange("www.example.", dns.TypeA)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 2 || !r.RecursionAvailable {
+		t.Fatalf("unexpected response: %v", r)
+	}
+	if a, ok := r.Answer[1].(*dns.A); !ok || a.A.String() != "192.0.2.10" {
+		t.Errorf("unexpected answer: %v", r.Answer[1])
+	}
+
+	// the CNAME target out of the bailiwick is resolved from its own zone
+	r = exchange("mail.example.", dns.TypeA)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 2 {
+		t.Fatalf("unexpected response: %v", r)
+	}
+	if a, ok := r.Answer[1].(*dns.A); !ok || a.A.String() != "192.0.2.20" {
+		t.Errorf("took the answer out of the bailiwick: %v", r.Answer[1])
+	}
+
+	// the zone cuts are cached
+	n := atomic.LoadInt32(roots)
+	r = exchange("nope.corp.example.", dns.TypeA)
+	if r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("unexpected NXDOMAIN response: %v", r)
+	}
+	r = exchange("txt.corp.example.", dns.TypeA)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Errorf("unexpected NODATA response: %v", r)
+	}
+	if atomic.LoadInt32(roots) != n {
+		t.Errorf("queried the root servers for the cached zone cuts")
+	}
+
+	if r = exchange("www.example.org.", dns.TypeA); r.Rcode != dns.RcodeNameError {
+		t.Errorf("unexpected response: %v", r)
+	}
+}
+
+func TestParseRootHints(t *testing.T) {
+	it, err := newIterator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(it.closest("example.com.").servers); n != 13 {
+		t.Errorf("got %d root servers, expected 13", n)
+	}
+
+	if _, err := parseRootHints(strings.NewReader(". 3600000 NS a.root-servers.test.\n"), ""); err == nil {
+		t.Error("parsed the root hints without addresses")
+	}
+}
+
+func TestIteratorZoneCuts(t *testing.T) {
+	it, err := newIterator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &iteration{iterator: it}
+	refer := func(zone string) {
+		m := new(dns.Msg).SetQuestion("www."+zone, dns.TypeA)
+		ns, _ := dns.NewRR(zone + " 60 IN NS ns." + zone)
+		glue, _ := dns.NewRR("ns." + zone + " 60 IN A 192.0.2.53")
+		m.Ns, m.Extra = []dns.RR{ns}, []dns.RR{glue}
+		if _, ok := st.referral(it.root, "www."+zone, m); !ok {
+			t.Fatalf("no referral to %s", zone)
+		}
+	}
+
+	// the expired zone cut is removed
+	refer("example.com.")
+	if d := it.closest("www.example.com."); d.zone != "example.com." {
+		t.Errorf("got the zone cut %s, expected example.com.", d.zone)
+	}
+	v, _ := it.zones.Find("example.com.")
+	v.(*Record).Expired = time.Now().Add(-time.Second)
+	if d := it.closest("www.example.com."); d != it.root {
+		t.Errorf("got the expired zone cut %s", d.zone)
+	}
+	if n := it.zones.Stats().Entries; n != 0 {
+		t.Errorf("%d zone cuts are cached, expected 0", n)
+	}
+
+	// the zone cuts are bounded
+	for i := 0; i <= maxZoneCuts; i++ {
+		refer(fmt.Sprintf("%d.example.", i))
+	}
+	if s := it.zones.Stats(); s.Entries != maxZoneCuts || s.Evictions != 1 {
+		t.Errorf("unexpected stats of the zone cuts: %+v", s)
+	}
+	if d := it.closest("www.0.example."); d != it.root {
+		t.Errorf("got the evicted zone cut %s", d.zone)
+	}
+}
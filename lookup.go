@@ -0,0 +1,169 @@
+package dnsproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// localAddr is the client's address of the in-process queries.
+type localAddr struct{}
+
+func (localAddr) Network() string { return "local" }
+func (localAddr) String() string  { return "local" }
+
+// localWriter keeps the response of the in-process query.
+type localWriter struct {
+	resp *dns.Msg
+}
+
+func (w *localWriter) RemoteAddr() net.Addr {
+	return localAddr{}
+}
+
+func (w *localWriter) WriteMsg(msg *dns.Msg) error {
+	if w.resp != nil {
+		return ErrWritten
+	}
+	setResponse(msg, false, 0)
+	w.resp = msg
+	return nil
+}
+
+// Exchange resolves the query in process, with the middlewares, the cache
+// and the up dns servers, like the queries from the network.
+func (p *Proxy) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if len(msg.Question) == 0 {
+		return nil, ErrInvalidQuery
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	w := &localWriter{}
+	p.serve(ctx, w, msg)
+	if w.resp == nil {
+		return nil, ErrNoResponse
+	}
+	return w.resp, nil
+}
+
+// LookupIP looks up the IPv4 and IPv6 addresses of the host.
+func (p *Proxy) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+	var lastErr error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg, err := p.lookup(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range msg.Answer {
+			switch x := rr.(type) {
+			case *dns.A:
+				ips = append(ips, x.A)
+			case *dns.AAAA:
+				ips = append(ips, x.AAAA)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		if lastErr == nil {
+			lastErr = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return nil, lastErr
+	}
+	return ips, nil
+}
+
+// LookupCNAME looks up the canonical name of the host,
+// which is the host itself if it has no CNAME.
+func (p *Proxy) LookupCNAME(ctx context.Context, host string) (string, error) {
+	msg, err := p.lookup(ctx, host, dns.TypeA)
+	if err != nil {
+		return "", err
+	}
+	if cname, ok := FindCname(msg); ok {
+		return cname, nil
+	}
+	return dns.Fqdn(host), nil
+}
+
+// LookupTXT looks up the TXT records of the host,
+// the strings of a record are joined.
+func (p *Proxy) LookupTXT(ctx context.Context, host string) ([]string, error) {
+	msg, err := p.lookup(ctx, host, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	var txts []string
+	for _, rr := range msg.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			txts = append(txts, strings.Join(txt.Txt, ""))
+		}
+	}
+	return txts, nil
+}
+
+func (p *Proxy) lookup(ctx context.Context, host string, qtype uint16) (*dns.Msg, error) {
+	msg, err := p.Exchange(ctx, new(dns.Msg).SetQuestion(dns.Fqdn(host), qtype))
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: host}
+	}
+	switch msg.Rcode {
+	case dns.RcodeSuccess:
+		return msg, nil
+	case dns.RcodeNameError:
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	default:
+		return nil, &net.DNSError{Err: dns.RcodeToString[msg.Rcode], Name: host, IsTemporary: true}
+	}
+}
+
+// Dial dials to the proxy in process, it can be used as net.Resolver.Dial:
+//
+//	r := &net.Resolver{PreferGo: true, Dial: p.Dial}
+//
+// The network and address are ignored, and the queries on the
+// connection are length-prefixed as DNS over TCP.
+func (p *Proxy) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go p.servePipe(server)
+	return client, nil
+}
+
+func (p *Proxy) servePipe(conn net.Conn) {
+	defer conn.Close()
+
+	header := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+
+		msg := new(dns.Msg)
+		if err := msg.Unpack(data); err != nil {
+			return
+		}
+		resp, err := p.Exchange(context.Background(), msg)
+		if err != nil {
+			resp = NewServerFailure(msg)
+		}
+		if data, err = resp.Pack(); err != nil {
+			return
+		}
+		if _, err := conn.Write(lengthPrefixed(data)); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package dnsproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newTestLookupProxy(t *testing.T) *Proxy {
+	zone := map[uint16][]string{
+		dns.TypeA:    {"www.example. 60 IN A 192.0.2.1"},
+		dns.TypeAAAA: {"www.example. 60 IN AAAA 2001:db8::1"},
+		dns.TypeTXT:  {`www.example. 60 IN TXT "v=spf1" " -all"`},
+	}
+	up := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg).SetReply(r)
+		q := r.Question[0]
+		switch q.Name {
+		case "alias.example.":
+			rr, _ := dns.NewRR("alias.example. 60 IN CNAME www.example.")
+			msg.Answer = append(msg.Answer, rr)
+			fallthrough
+		case "www.example.":
+			for _, s := range zone[q.Qtype] {
+				rr, _ := dns.NewRR(s)
+				msg.Answer = append(msg.Answer, rr)
+			}
+		default:
+			msg.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(msg)
+	})
+	p, err := NewProxy(&Config{UpServers: []string{up}, WithCache: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestLookup(t *testing.T) {
+	p := newTestLookupProxy(t)
+	ctx := context.Background()
+
+	if ips, err := p.LookupIP(ctx, "alias.example"); err != nil || len(ips) != 2 {
+		t.Errorf("LookupIP: %v, err: %v", ips, err)
+	}
+	if cname, err := p.LookupCNAME(ctx, "alias.example"); err != nil || cname != "www.example." {
+		t.Errorf("LookupCNAME: %s, err: %v", cname, err)
+	}
+	if txts, err := p.LookupTXT(ctx, "www.example"); err != nil || len(txts) != 1 || txts[0] != "v=spf1 -all" {
+		t.Errorf("LookupTXT: %v, err: %v", txts, err)
+	}
+	_, err := p.LookupIP(ctx, "nx.example")
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+		t.Errorf("LookupIP of a non-existent host: %v", err)
+	}
+}
+
+func TestDial(t *testing.T) {
+	p := newTestLookupProxy(t)
+	r := &net.Resolver{PreferGo: true, Dial: p.Dial}
+
+	addrs, err := r.LookupHost(context.Background(), "www.example")
+	if err != nil || len(addrs) != 2 {
+		t.Errorf("LookupHost: %v, err: %v", addrs, err)
+	}
+}
@@ -0,0 +1,404 @@
+package dnsproxy
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Proxy is the core of dnsproxy, which resolves the queries with the
+// middlewares, the cache and the up dns servers. It is shared by all the
+// transports of Server, and implements dns.Handler to be mounted in the
+// existing dns.Server.
+type Proxy struct {
+	config *Config
+
+	upstreams *upstreamGroup
+	forwards  *Trie            // domain to *upstreamGroup, nil without Forwards
+	groups    []*upstreamGroup // all the up server groups
+	owned     []Upstream       // parsed from UpServers and Forwards, closed by Close
+	iterator  *iterator        // nil if not Recursive
+	validator *validator       // nil if not DNSSEC
+	handler   Handler
+	logger    *log.Logger
+
+	cache     *ShardedCache
+	cacheChan chan cacheItem
+	cacheMu   sync.RWMutex // guards sending to cacheChan against closing it
+	closed    bool
+	writers   sync.WaitGroup // goroutines of the cache, the janitor, the probes and the refreshes
+
+	refreshing sync.Map // cache keys of the stale records being refreshed
+	failed     sync.Map // cache keys to the time of the failed refreshes
+
+	done   chan struct{}   // closed by Close
+	ctx    context.Context // of the background queries, canceled by Close
+	cancel context.CancelFunc
+}
+
+// NewProxy creates a dnsproxy core with the config, whose address,
+// worker pool and listeners are ignored.
+func NewProxy(cfg *Config) (*Proxy, error) {
+	if cfg == nil {
+		return nil, ErrInvalidConfig
+	}
+	cfg.check()
+	owned, err := cfg.parseUpstreams()
+	if err != nil {
+		return nil, err
+	}
+	var probe *dns.Msg
+	if cfg.HealthProbe != "" {
+		if probe, err = parseProbe(cfg.HealthProbe); err != nil {
+			closeUpstreams(owned)
+			return nil, err
+		}
+	}
+
+	p := &Proxy{
+		config: cfg,
+		owned:  owned,
+		logger: cfg.Logger,
+		done:   make(chan struct{}),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	if p.logger == nil {
+		p.logger = log.Default()
+	}
+	p.upstreams, err = p.newGroup(append(owned[:len(owned):len(owned)], cfg.Upstreams...), cfg.weights())
+	if err == nil {
+		err = p.setForwards()
+	}
+	if err == nil && cfg.Recursive {
+		p.iterator, err = newIterator(cfg.RootHints)
+	}
+	if err == nil && cfg.DNSSEC {
+		p.validator, err = newValidator(cfg.TrustAnchors, func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+			return p.newResolver(ctx, msg.Question[0].Name).resolve(msg)
+		})
+	}
+	if err != nil {
+		p.cancel()
+		closeUpstreams(p.owned)
+		return nil, err
+	}
+	if probe != nil {
+		for _, g := range p.groups {
+			g.probing = true
+			p.writers.Add(1)
+			go func(g *upstreamGroup) {
+				defer p.writers.Done()
+				g.probe(probe, cfg.HealthInterval, p.done)
+			}(g)
+		}
+	}
+
+	mws := cfg.Middlewares
+	if p.validator != nil {
+		mws = append(mws[:len(mws):len(mws)], p.dnssecMiddleware)
+	}
+	if cfg.WithCache {
+		p.cache = NewShardedCache(cfg.CacheMaxEntries, cfg.CacheMaxBytes, cfg.CacheStaleWindow)
+		p.cacheChan = make(chan cacheItem, cfg.WorkerPoolMax)
+		mws = append(mws[:len(mws):len(mws)], p.cacheMiddleware)
+		p.writers.Add(2)
+		go p.cacheMsg()
+		go p.sweepCache()
+		if cfg.CacheFile != "" {
+			if err := p.cache.LoadFile(cfg.CacheFile); err != nil && !os.IsNotExist(err) {
+				p.logger.Printf("dnsproxy: failed to load cache from %s, err: %v", cfg.CacheFile, err)
+			}
+			p.writers.Add(1)
+			go p.saveCache()
+		}
+	}
+	p.handler = Chain(HandlerFunc(p.resolveHandler), mws...)
+	return p, nil
+}
+
+// ServeDNS implements dns.Handler.
+func (p *Proxy) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) == 0 {
+		w.WriteMsg(new(dns.Msg).SetRcode(r, dns.RcodeFormatError))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, isUDP := w.RemoteAddr().(*net.UDPAddr)
+	size := udpSize(r, p.config.UDPMaxSize)
+	p.serve(ctx, &responseWriterFunc{
+		ResponseWriter: w,
+		write: func(msg *dns.Msg) error {
+			setResponse(msg, isUDP, size)
+			return w.WriteMsg(msg)
+		},
+	}, r)
+}
+
+// serve passes the query to the handler chain.
+func (p *Proxy) serve(ctx context.Context, w ResponseWriter, r *dns.Msg) {
+	p.handler.ServeDNS(ctx, w, r)
+}
+
+// Close cancels the background refreshes, waits for them and the pending
+// cache writes, closes the up dns servers
+// parsed from UpServers and Forwards, and saves the cache to CacheFile.
+func (p *Proxy) Close() error {
+	p.cacheMu.Lock()
+	if p.closed {
+		p.cacheMu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	p.cancel()
+	if p.cacheChan != nil {
+		close(p.cacheChan)
+	}
+	p.cacheMu.Unlock()
+
+	p.writers.Wait()
+	closeUpstreams(p.owned)
+	if p.cache != nil && p.config.CacheFile != "" {
+		return p.cache.SaveFile(p.config.CacheFile)
+	}
+	return nil
+}
+
+// UpstreamHealth gets the health states of the up dns servers,
+// including the ones of the forwarding rules.
+func (p *Proxy) UpstreamHealth() []UpstreamHealth {
+	var hs []UpstreamHealth
+	for _, g := range p.groups {
+		hs = append(hs, g.health()...)
+	}
+	return hs
+}
+
+// CacheStats gets the statistics of the cache.
+func (p *Proxy) CacheStats() CacheStats {
+	if p.cache == nil {
+		return CacheStats{}
+	}
+	return p.cache.Stats()
+}
+
+func (p *Proxy) newGroup(ups []Upstream, weights []int) (*upstreamGroup, error) {
+	g, err := newUpstreamGroup(p.config.Strategy, ups, weights)
+	if err != nil {
+		return nil, err
+	}
+	g.logger = p.logger
+	p.groups = append(p.groups, g)
+	return g, nil
+}
+
+// setResponse sets the response flags, and truncates the oversized
+// response over udp with TC bit, the client should retry over tcp.
+func setResponse(msg *dns.Msg, isUDP bool, size int) {
+	msg.Response = true
+	msg.RecursionAvailable = true
+	if isUDP {
+		msg.Truncate(size)
+	}
+}
+
+// udpSize gets the max size of the response over udp, which is
+// advertised by the client's EDNS0, or 512 without EDNS0.
+func udpSize(msg *dns.Msg, max int) int {
+	size := dns.MinMsgSize
+	if opt := msg.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if size > max {
+		size = max
+	}
+	return size
+}
+
+// cacheMiddleware responds to the query from the cache, or the stale
+// cache as RFC 8767, and caches the responses of the next handler.
+func (p *Proxy) cacheMiddleware(next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *dns.Msg) {
+		if msg, ok := p.resolveCache(r); ok {
+			w.WriteMsg(msg)
+			return
+		}
+		if stale, ok := p.resolveStale(r); ok {
+			p.serveStale(ctx, w, r, next, stale)
+			return
+		}
+
+		next.ServeDNS(ctx, &responseWriterFunc{
+			ResponseWriter: w,
+			write: func(msg *dns.Msg) error {
+				p.cacheResponse(r, msg)
+				return w.WriteMsg(msg)
+			},
+		}, r)
+	})
+}
+
+// cacheResponse caches the answers and the negative responses to r,
+// but not the ones whose question does not match r.
+func (p *Proxy) cacheResponse(r, msg *dns.Msg) {
+	cacheable := msg.Rcode == dns.RcodeSuccess || msg.Rcode == dns.RcodeNameError
+	if cacheable && isReplyTo(r, msg) && !(p.validator != nil && r.CheckingDisabled) {
+		p.toCache(r.Question[0], msg.Copy())
+	}
+}
+
+func (p *Proxy) resolveCache(msg *dns.Msg) (*dns.Msg, bool) {
+	return p.cachedResponse(msg, p.cache.Get)
+}
+
+// cachedResponse gets the response to the query from the record got by
+// get, the one of the question or the NXDOMAIN of the name.
+func (p *Proxy) cachedResponse(msg *dns.Msg, get func(key string) (*Record, bool)) (*dns.Msg, bool) {
+	r, ok := get(getQuetion(msg))
+	if !ok {
+		r, ok = get(nxdomainKey(msg.Question[0].Name))
+	}
+	if !ok {
+		return nil, false
+	}
+	_msg := r.Copy()
+	_msg.Id = msg.Id
+	_msg.Question = msg.Question
+	if p.validator != nil {
+		// the AD bit of the upstream is passed through without DNSSEC
+		_msg.AuthenticatedData = r.Security == SecuritySecure
+	}
+	return _msg, true
+}
+
+// resolveHandler resolves the query with the up dns servers, validates
+// the response if DNSSEC, and responds SERVFAIL if failed or bogus. The
+// names of the forwarding rules are not validated, as their zones may be
+// private and not delegated from the signed parents.
+func (p *Proxy) resolveHandler(ctx context.Context, w ResponseWriter, r *dns.Msg) {
+	msg, err := p.newResolver(ctx, r.Question[0].Name).resolve(r)
+	if err == nil && p.validator != nil && !r.CheckingDisabled {
+		security := SecurityBogus // not a reply to r
+		if _, ok := p.forwardOf(r.Question[0].Name); ok {
+			security = SecurityUnknown
+		} else if isReplyTo(r, msg) {
+			security = p.validator.validate(ctx, msg)
+		}
+		switch security {
+		case SecuritySecure:
+			msg.AuthenticatedData = true
+		case SecurityBogus:
+			err = ErrBogus
+		default:
+			msg.AuthenticatedData = false
+		}
+	}
+	if err != nil {
+		msg = NewServerFailure(r)
+	}
+	w.WriteMsg(msg)
+}
+
+// newResolver gets the resolver of name by the forwarding rules,
+// or the iterator in the recursive mode, or the default up dns servers.
+func (p *Proxy) newResolver(ctx context.Context, name string) iresolver {
+	if g, ok := p.forwardOf(name); ok {
+		// the names of the forwarding rules are never sent elsewhere
+		return newPlainResolver(ctx, g)
+	}
+	if p.iterator != nil {
+		return p.iterator.newResolver(ctx)
+	}
+	return newResolver(ctx, p.upstreams)
+}
+
+// cacheItem is the response msg to be cached by the question of the query.
+type cacheItem struct {
+	question dns.Question
+	msg      *dns.Msg
+}
+
+func (p *Proxy) toCache(q dns.Question, msg *dns.Msg) {
+	p.cacheMu.RLock()
+	if !p.closed {
+		p.cacheChan <- cacheItem{question: q, msg: msg}
+	}
+	p.cacheMu.RUnlock()
+}
+
+func (p *Proxy) cacheMsg() {
+	defer p.writers.Done()
+	for {
+		item, ok := <-p.cacheChan
+		if !ok {
+			return
+		}
+		msg := item.msg
+		r, ok := newRecord(msg, p.config.CacheMinTTL, p.config.CacheMaxTTL)
+		if ok {
+			key := questionKey(item.question)
+			if r.IsNXDomain() && len(msg.Answer) == 0 {
+				// the name does not exist for all the types
+				key = nxdomainKey(item.question.Name)
+			}
+			if p.validator != nil {
+				r.Security = SecurityInsecure
+				if msg.AuthenticatedData {
+					r.Security = SecuritySecure
+				}
+			}
+			p.cache.Add(key, r)
+		}
+	}
+}
+
+// saveCache saves the cache to CacheFile periodically.
+func (p *Proxy) saveCache() {
+	defer p.writers.Done()
+	ticker := time.NewTicker(p.config.CacheSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		if err := p.cache.SaveFile(p.config.CacheFile); err != nil {
+			p.logger.Printf("dnsproxy: failed to save cache to %s, err: %v", p.config.CacheFile, err)
+		}
+	}
+}
+
+// sweepCache removes the expired records from the cache periodically.
+func (p *Proxy) sweepCache() {
+	defer p.writers.Done()
+	ticker := time.NewTicker(p.config.CacheSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		p.cache.Sweep(p.done)
+		p.failed.Range(func(key, v interface{}) bool {
+			if time.Since(v.(time.Time)) >= p.config.StaleRecheckInterval {
+				p.failed.Delete(key)
+			}
+			return true
+		})
+	}
+}
+
+// nxdomainKey is the cache key of the NXDOMAIN of name for all the types.
+func nxdomainKey(name string) string {
+	return "nxdomain." + name
+}
@@ -0,0 +1,318 @@
+package dnsproxy
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestProxyHandler(t *testing.T) {
+	up := newTestUpstream(t, answerA("192.0.2.1"))
+	p, err := NewProxy(&Config{UpServers: []string{up}, WithCache: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: p}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	m := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+	r, _, err := new(dns.Client).Exchange(m, pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.RecursionAvailable || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("unexpected response: %v", r)
+	}
+}
+
+func TestProxyTTLClamp(t *testing.T) {
+	up := newTestUpstream(t, answerA("192.0.2.1")) // TTL 60
+	p, err := NewProxy(&Config{UpServers: []string{up}, WithCache: true, CacheMaxTTL: 10 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	m := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+	if _, err := p.Exchange(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := p.cache.Get(getQuetion(m)); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the answer is not cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	r, err := p.Exchange(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].Header().Ttl > 10 {
+		t.Errorf("the cached ttl is not clamped: %v", r)
+	}
+}
+
+func TestProxyRcode(t *testing.T) {
+	exchange := func(cfg *Config) *dns.Msg {
+		p, err := NewProxy(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		r, err := p.Exchange(context.Background(), new(dns.Msg).SetQuestion("www.example.", dns.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	// the negative answers and the failures are passed through
+	for _, rcode := range []int{dns.RcodeNameError, dns.RcodeRefused} {
+		r := exchange(&Config{Upstreams: []Upstream{&fakeUpstream{rcode: rcode}}})
+		if r.Rcode != rcode {
+			t.Errorf("got rcode %s, expected %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[rcode])
+		}
+	}
+
+	// SERVFAIL if all the up servers fail
+	r := exchange(&Config{Upstreams: []Upstream{&fakeUpstream{failing: 1}, &fakeUpstream{failing: 1}}})
+	if r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("got rcode %s, expected SERVFAIL", dns.RcodeToString[r.Rcode])
+	}
+
+	// NODATA with the SOA and NS in the authority is not a referral
+	up := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg).SetReply(r)
+		soa, _ := dns.NewRR("example. 300 SOA ns.example. admin.example. 1 3600 600 86400 60")
+		ns, _ := dns.NewRR("example. 300 NS ns.example.")
+		msg.Ns = []dns.RR{soa, ns}
+		w.WriteMsg(msg)
+	})
+	r = exchange(&Config{UpServers: []string{up}})
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 || len(r.Ns) != 2 {
+		t.Errorf("unexpected NODATA response: %v", r)
+	}
+}
+
+func TestProxyNegativeCache(t *testing.T) {
+	var queries int32
+	up := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		msg := new(dns.Msg).SetReply(r)
+		switch {
+		case r.Question[0].Name != "www.example.":
+			msg.Rcode = dns.RcodeNameError
+		case r.Question[0].Qtype == dns.TypeA:
+			rr, _ := dns.NewRR("www.example. 60 IN A 192.0.2.1")
+			msg.Answer = append(msg.Answer, rr)
+		}
+		if len(msg.Answer) == 0 {
+			soa, _ := dns.NewRR("example. 300 SOA ns.example. admin.example. 1 3600 600 86400 60")
+			msg.Ns = append(msg.Ns, soa)
+		}
+		w.WriteMsg(msg)
+	})
+	p, err := NewProxy(&Config{UpServers: []string{up}, WithCache: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	exchange := func(name string, qtype uint16) *dns.Msg {
+		r, err := p.Exchange(context.Background(), new(dns.Msg).SetQuestion(name, qtype))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	cached := func(key string) {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			if _, ok := p.cache.Get(key); ok {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s is not cached", key)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	exchange("www.example.", dns.TypeAAAA)
+	exchange("nope.example.", dns.TypeA)
+	cached("aaaa.www.example.")
+	cached(nxdomainKey("nope.example."))
+	n := atomic.LoadInt32(&queries)
+
+	r := exchange("www.example.", dns.TypeAAAA)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 || len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("unexpected cached NODATA: %v", r)
+	}
+	// NXDOMAIN is of all the types
+	r = exchange("nope.example.", dns.TypeTXT)
+	if r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 || r.Ns[0].Header().Ttl > 300 || r.Question[0].Qtype != dns.TypeTXT {
+		t.Errorf("unexpected cached NXDOMAIN: %v", r)
+	}
+	if atomic.LoadInt32(&queries) != n {
+		t.Error("queried the up server for the cached negative responses")
+	}
+
+	// NODATA is of the type only
+	if r = exchange("www.example.", dns.TypeA); len(r.Answer) != 1 || atomic.LoadInt32(&queries) != n+1 {
+		t.Errorf("unexpected answer: %v", r)
+	}
+}
+
+func TestProxyCacheMismatch(t *testing.T) {
+	up := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg).SetReply(r)
+		switch r.Question[0].Name {
+		case "empty.example.":
+			msg.Question = nil
+		case "other.example.":
+			msg.Question[0].Name = "www.example."
+		}
+		rr, _ := dns.NewRR("www.example. 60 IN A 192.0.2.1")
+		msg.Answer = append(msg.Answer, rr)
+		w.WriteMsg(msg)
+	})
+	// the forwarded replies are passed through as is
+	for _, forwards := range []map[string][]string{nil, {"example.": {up}}} {
+		p, err := NewProxy(&Config{UpServers: []string{up}, Forwards: forwards, WithCache: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"empty.example.", "other.example."} {
+			if _, err := p.Exchange(context.Background(), new(dns.Msg).SetQuestion(name, dns.TypeA)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		p.Close() // waits for the cache writer
+		for _, key := range []string{"a.empty.example.", "a.other.example.", "a.www.example."} {
+			if _, ok := p.cache.Get(key); ok {
+				t.Errorf("the mismatched reply is cached as %s, forwards: %v", key, forwards)
+			}
+		}
+	}
+}
+
+func TestProxyCacheAD(t *testing.T) {
+	answer := answerA("192.0.2.1")
+	up := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		answer(&adWriter{w}, r)
+	})
+	p, err := NewProxy(&Config{UpServers: []string{up}, WithCache: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	m := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		r, err := p.Exchange(context.Background(), m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.AuthenticatedData {
+			t.Errorf("the AD bit of the upstream is cleared, cached: %v", i > 0)
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			if _, ok := p.cache.Get(getQuetion(m)); ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("the answer is not cached")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// adWriter sets the AD bit of the responses.
+type adWriter struct {
+	dns.ResponseWriter
+}
+
+func (w *adWriter) WriteMsg(msg *dns.Msg) error {
+	msg.AuthenticatedData = true
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+func TestProxyCacheFile(t *testing.T) {
+	var queries int32
+	answer := answerA("192.0.2.1")
+	up := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		answer(w, r)
+	})
+	cfg := &Config{
+		UpServers: []string{up},
+		WithCache: true,
+		CacheFile: filepath.Join(t.TempDir(), "cache.json"),
+	}
+	p, err := NewProxy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+	if _, err := p.Exchange(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// restart with the warm cache
+	if p, err = NewProxy(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	r, err := p.Exchange(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || atomic.LoadInt32(&queries) != 1 {
+		t.Errorf("unexpected response: %v, queries: %d", r, queries)
+	}
+}
+
+func TestProxyCacheJanitor(t *testing.T) {
+	p, err := NewProxy(&Config{WithCache: true, CacheSweepInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	r := newTestRecord("www.example.")
+	r.Expired = time.Now().Add(50 * time.Millisecond)
+	p.cache.Add("a.www.example.", r)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for p.CacheStats().Expired != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the expired record is not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := p.cache.Get("a.www.example."); ok {
+		t.Error("the expired record is found")
+	}
+}
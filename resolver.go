@@ -1,9 +1,7 @@
 package dnsproxy
 
 import (
-	"encoding/binary"
-	"io"
-	"net"
+	"context"
 	"time"
 
 	"github.com/miekg/dns"
@@ -23,13 +21,13 @@ var (
 
 type iresolver interface {
 	resolve(*dns.Msg) (*dns.Msg, error)
-	close()
 }
 
+// resolver resolves a query, the resolving is canceled once ctx is done.
 type resolver struct {
-	worker  *worker
-	conns   []*net.UDPConn
-	servers []string
+	upstreams *upstreamGroup
+
+	ctx context.Context
 
 	ts time.Time
 }
@@ -50,36 +48,22 @@ type iterativeResolver struct {
 	raw, msg *dns.Msg
 }
 
-func newResolver(w *worker, upServers []string) iresolver {
+func newResolver(ctx context.Context, upstreams *upstreamGroup) iresolver {
 	r := &resolver{
-		worker:  w,
-		servers: upServers,
-		ts:      time.Now(),
-	}
-	if len(upServers) == 0 {
-		upServers = upDNS
-	} else if len(upServers) > 3 {
-		upServers = upServers[:3]
-	}
-	for _, s := range upServers {
-		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(s, "53"))
-		if err != nil {
-			continue
-		}
-		conn, err := net.DialUDP("udp", nil, addr)
-		if err != nil {
-			continue
-		}
-		r.conns = append(r.conns, conn)
+		upstreams: upstreams,
+		ctx:       ctx,
+		ts:        time.Now(),
 	}
 	return &recursiveResolver{resolver: r}
 }
 
-func (r *resolver) close() {
-	for _, conn := range r.conns {
-		if conn != nil {
-			conn.Close()
-		}
+// newPlainResolver creates a resolver which passes the replies of the up
+// dns servers as is, without falling back to the iterative resolving.
+func newPlainResolver(ctx context.Context, upstreams *upstreamGroup) iresolver {
+	return &resolver{
+		upstreams: upstreams,
+		ctx:       ctx,
+		ts:        time.Now(),
 	}
 }
 
@@ -88,49 +72,45 @@ func (r *resolver) isTimeout() bool {
 }
 
 func (r *resolver) resolve(msg *dns.Msg) (*dns.Msg, error) {
-	data, err := msg.Pack()
-	if err != nil {
-		return nil, err
-	}
 	// resolve with default up servers
-	return r.resolving(data, "", r.do)
+	return r.upstreams.exchange(r.ctx, msg)
 }
 
 func (r *resolver) resolveWithServers(msg *dns.Msg, servers []string) (*dns.Msg, error) {
-	data, err := msg.Pack()
-	if err != nil {
-		return nil, err
-	}
-
 	for _, s := range servers {
-		// resolve with up UDP server
-		_msg, err := r.resolving(data, s, r.doWithUDP)
+		u, err := ParseUpstream(s)
+		if err != nil {
+			continue
+		}
+		_msg, err := r.exchange(u, msg)
 		if err == nil {
 			return _msg, nil
 		}
-
-		if err == dns.ErrTruncated {
-			// resolve with up TCP server
-			_msg, err = r.resolving(data, s, r.doWithTCP)
-			if err == nil {
-				return _msg, nil
-			}
-		}
 	}
 	return nil, ErrNotFound
 }
 
+func (r *resolver) exchange(u Upstream, msg *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(r.ctx, wait)
+	defer cancel()
+	return u.Exchange(ctx, msg)
+}
+
 func (rr *recursiveResolver) resolve(msg *dns.Msg) (*dns.Msg, error) {
 	_msg, err := rr.resolver.resolve(msg)
 	if err != nil {
 		return nil, ErrServerFailed
 	}
+	if !isReplyTo(msg, _msg) {
+		return nil, ErrInvalidResponse
+	}
+
+	if !IsSuccessfulResponse(_msg) || IsNoDataResponse(_msg) {
+		// pass the negative answers and failures through
+		return _msg, nil
+	}
 
 	if GotAnswer(_msg) {
-		// cache the A/AAAA/CNAME RRs
-		if rr.worker.withCache {
-			rr.worker.server.toCache(_msg.Copy())
-		}
 		return _msg, nil
 	}
 
@@ -158,15 +138,15 @@ func (ir *iterativeResolver) resolve(msg *dns.Msg) (*dns.Msg, error) {
 		return nil, ErrServerFailed
 	}
 
-	if ir.raw.Id != msg.Id {
+	if ir.raw.Id != msg.Id || len(msg.Question) == 0 {
 		return nil, ErrInvalidResponse
 	}
 
+	if !IsSuccessfulResponse(msg) {
+		return msg, nil
+	}
+
 	if GotAnswer(msg) {
-		// cache A/AAAA/CNAME RRs
-		if ir.worker.withCache {
-			ir.worker.server.toCache(msg.Copy())
-		}
 		return msg, nil
 	}
 
@@ -244,116 +224,3 @@ func (ir *iterativeResolver) cname(msg *dns.Msg, names, servers []string) (*dns.
 	_msg.Answer = append(_msg.Answer, answers...)
 	return _msg, nil
 }
-
-type resolvingHandleFunc func(string, []byte, []byte) ([]byte, error)
-
-func (r *resolver) resolving(data []byte, server string, handle resolvingHandleFunc) (*dns.Msg, error) {
-	pckSize := 512
-	recv := make([]byte, pckSize) // mostly, response is less than 512
-	var err error
-	for {
-		recv, err = handle(server, data, recv)
-		if err != nil {
-			break
-		}
-		msg := &dns.Msg{}
-		err = msg.Unpack(recv)
-		if err == nil {
-			// got the message
-			return msg, nil
-		}
-
-		if err == dns.ErrBuf { // buffer is too small
-			if pckSize == 4096 {
-				err = ErrHugePacket
-				break
-			}
-			pckSize *= 2
-			recv = make([]byte, pckSize) // to receive a huge response
-			continue
-		}
-		break
-	}
-
-	if err == dns.ErrTruncated {
-		msg := &dns.Msg{}
-		recvData := make([]byte, 1<<12) // 4096
-		for i := range r.servers {
-			recv, err = r.doWithTCP(r.servers[i], data, recvData)
-			if err != nil {
-				continue
-			}
-			err = msg.Unpack(recv)
-			if err == nil {
-				return msg, nil
-			}
-		}
-		return nil, err
-	}
-
-	if err != nil {
-	} else {
-		err = ErrServerFailed
-	}
-	return nil, err
-}
-
-func (r *resolver) do(_ string, data, recv []byte) ([]byte, error) {
-	for _, conn := range r.conns {
-		conn.SetDeadline(time.Now().Add(wait))
-		if _, err := conn.Write(data); err != nil {
-			continue
-		}
-		n, err := conn.Read(recv)
-		if err != nil {
-			continue
-		}
-		return recv[:n], nil
-	}
-	return recv, ErrNotFound
-}
-
-func (r *resolver) doWithUDP(s string, data, rcv []byte) ([]byte, error) {
-	raddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(s, "53"))
-	if err != nil {
-		return rcv, err
-	}
-	conn, err := net.DialUDP("udp", nil, raddr)
-	if err != nil {
-		return rcv, err
-	}
-	defer conn.Close()
-	conn.SetDeadline(time.Now().Add(wait)) // 2 second timeout
-	if _, err = conn.Write(data); err != nil {
-		return rcv, err
-	}
-	n, err := conn.Read(rcv)
-	return rcv[:n], err
-}
-
-func (r *resolver) doWithTCP(s string, data, rcv []byte) ([]byte, error) {
-	raddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(s, "53"))
-	if err != nil {
-		return rcv, err
-	}
-	conn, err := net.DialTCP("tcp", nil, raddr)
-	if err != nil {
-		return rcv, err
-	}
-	defer conn.Close()
-	conn.SetDeadline(time.Now().Add(wait)) // 2 second timeout
-	_data := make([]byte, len(data)+2)
-	binary.BigEndian.PutUint16(_data[:2], uint16(len(data)))
-	copy(_data[2:], data)
-	if _, err = conn.Write(_data); err != nil {
-		return rcv, err
-	}
-	header := []byte{0, 0}
-	_, err = io.ReadFull(conn, header)
-	if err != nil {
-		return rcv, err
-	}
-	rcv = make([]byte, binary.BigEndian.Uint16(header))
-	n, err := conn.Read(rcv)
-	return rcv[:n], err
-}
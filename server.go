@@ -1,8 +1,15 @@
 package dnsproxy
 
 import (
+	"context"
+	"encoding/binary"
+	"fmt"
 	"io"
+	"log"
 	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -13,15 +20,105 @@ type Config struct {
 	// address to listen on
 	Addr string
 
-	// up dns servers to proxy
+	// up dns servers to proxy, see ParseUpstream for the formats
 	UpServers []string
 
-	// proxy with dns cache
-	WithCache bool
-	CacheFile string
+	// custom up dns servers, used after UpServers
+	Upstreams []Upstream
+
+	// strategy to select the up dns servers, one of sequential (default),
+	// round_robin, weighted_random, fastest and parallel
+	Strategy string
+
+	// weights of UpServers for weighted_random, 1 by default,
+	// custom up dns servers can have weights by a `Weight() int` method
+	Weights map[string]int
+
+	// forwarding rules of the domains to their own up dns servers, like
+	// "corp.example." to []string{"10.0.0.53"}, the longest matched domain
+	// wins, and the others are sent to UpServers and Upstreams
+	Forwards map[string][]string
+
+	// resolve the queries iteratively from the root servers instead of
+	// UpServers and Upstreams, except the forwarded ones
+	Recursive bool
+
+	// root hints file in the format of named.root for the recursive mode,
+	// the built-in root servers are used if empty
+	RootHints string
+
+	// validate the responses by DNSSEC, the bogus ones are failed,
+	// except the forwarded ones
+	DNSSEC bool
+
+	// DS or DNSKEY RRs of the DNSSEC trust anchors, like
+	// ". IN DS 20326 8 2 E06D...", the root KSK by default
+	TrustAnchors []string
+
+	// probe query of the up dns servers' active health checks, like
+	// "example.com. A", the down up servers are retried by the queries
+	// after their backoff if empty
+	HealthProbe string
+
+	// interval of the active health checks, 10s by default
+	HealthInterval time.Duration
+
+	// logger of the up dns servers' health changes, log.Default() if nil
+	Logger *log.Logger
+
+	// proxy with dns cache, which is loaded from CacheFile on start,
+	// and saved to it on shutdown and every CacheSaveInterval
+	WithCache         bool
+	CacheFile         string
+	CacheSaveInterval time.Duration // 5m by default
+
+	// limits of the cached records and their bytes, the least recently
+	// used records are evicted over the limits, no limit if 0
+	CacheMaxEntries, CacheMaxBytes int
+
+	// interval to remove the expired records from the cache, 1m by default
+	CacheSweepInterval time.Duration
+
+	// clamps of the TTLs of the cached records, no clamp if 0
+	CacheMinTTL, CacheMaxTTL time.Duration
+
+	// serve the expired records kept for CacheStaleWindow as RFC 8767, if
+	// the up dns servers fail or do not respond in StaleAnswerTimeout, 1.8s
+	// by default, with StaleAnswerTTL, 30s by default, disabled if 0. The
+	// failed refreshes are not retried in StaleRecheckInterval, 30s by default
+	CacheStaleWindow                   time.Duration
+	StaleAnswerTimeout, StaleAnswerTTL time.Duration
+	StaleRecheckInterval               time.Duration
 
 	// worker pool size
 	WorkerPoolMin, WorkerPoolMax int
+
+	// max size of the udp packets to receive and respond, 4096 by default
+	UDPMaxSize int
+
+	// idle timeout of the client's tcp, tls and https connections
+	TCPIdleTimeout time.Duration
+
+	// address to serve DNS-over-HTTPS on, disabled if empty
+	HTTPSAddr string
+
+	// address to serve DNS-over-TLS on, disabled if empty
+	TLSAddr string
+
+	// certificate and key files of the DNS-over-HTTPS and DNS-over-TLS
+	// servers, reloaded when they change
+	CertFile, KeyFile string
+
+	// CA file to verify the DNS-over-TLS clients' certificates,
+	// the clients are not required to have certificates if empty
+	ClientCAFile string
+
+	// reverse proxies whose X-Forwarded-For header is trusted, IPs or CIDRs
+	TrustedProxies []string
+
+	// middlewares around the built-in cache and resolving handlers,
+	// the first one is the outermost
+	Middlewares []Middleware
 }
 
 func (cfg *Config) check() {
@@ -31,24 +128,182 @@ func (cfg *Config) check() {
 	if cfg.WorkerPoolMax < cfg.WorkerPoolMin {
 		cfg.WorkerPoolMax = cfg.WorkerPoolMin + 10
 	}
+	if cfg.UDPMaxSize <= 0 {
+		cfg.UDPMaxSize = defaultUDPMaxSize
+	} else if cfg.UDPMaxSize < dns.MinMsgSize {
+		cfg.UDPMaxSize = dns.MinMsgSize
+	}
+	if cfg.HealthInterval <= 0 {
+		cfg.HealthInterval = defaultHealthInterval
+	}
+	if cfg.CacheSaveInterval <= 0 {
+		cfg.CacheSaveInterval = defaultCacheSaveInterval
+	}
+	if cfg.CacheSweepInterval <= 0 {
+		cfg.CacheSweepInterval = defaultCacheSweepInterval
+	}
+	if cfg.StaleAnswerTimeout <= 0 {
+		cfg.StaleAnswerTimeout = defaultStaleAnswerTimeout
+	}
+	if cfg.StaleAnswerTTL <= 0 {
+		cfg.StaleAnswerTTL = defaultStaleAnswerTTL
+	}
+	if cfg.StaleRecheckInterval <= 0 {
+		cfg.StaleRecheckInterval = defaultStaleRecheckInterval
+	}
+	if cfg.TCPIdleTimeout <= 0 {
+		cfg.TCPIdleTimeout = defaultTCPIdleTimeout
+	}
+}
+
+// parseUpstreams parses the UpServers, which are owned by the server.
+func (cfg *Config) parseUpstreams() ([]Upstream, error) {
+	servers := cfg.UpServers
+	if len(servers) == 0 && len(cfg.Upstreams) == 0 && !cfg.Recursive {
+		servers = upDNS
+	}
+	return ParseUpstreams(servers)
 }
 
-type server struct {
-	lconn    *net.UDPConn
-	config   *Config
-	pool     *workerPool
+// weights gets the weights of UpServers and Upstreams in order.
+func (cfg *Config) weights() []int {
+	weights := make([]int, 0, len(cfg.UpServers)+len(cfg.Upstreams))
+	for _, s := range cfg.UpServers {
+		weights = append(weights, cfg.Weights[s])
+	}
+	for _, u := range cfg.Upstreams {
+		w := 0
+		if wu, ok := u.(interface{ Weight() int }); ok {
+			w = wu.Weight()
+		}
+		weights = append(weights, w)
+	}
+	return weights
+}
+
+const (
+	defaultTCPIdleTimeout = time.Second * 10
+	defaultUDPMaxSize     = 4096
+
+	maxTCPMsgSize = 1<<16 - 1
+	maxTCPReplies = 64 // queued replies of a tcp connection not read by the client
+)
+
+// Server is a dnsproxy server, which owns its sockets, worker pool,
+// cache and goroutines.
+type Server struct {
+	mu      sync.Mutex // guards the listeners and the pool against shutdown
+	lconn   *net.UDPConn
+	tlisten *net.TCPListener
+	dlisten net.Listener // DNS-over-TLS
+	tconns  sync.Map     // *tcpConn -> struct{}
+	hlisten net.Listener
+	hserver *http.Server
+	config  *Config
+	pool    *workerPool
+
+	proxy *Proxy
+
 	recvChan chan *userPacket
 	sendChan chan *userPacket
 
-	cache     *Trie
-	cacheChan chan *dns.Msg
+	recvMu     sync.RWMutex // guards sending to recvChan against closing it
+	recvClosed bool
+
+	trustedProxies []*net.IPNet
+
+	readers sync.WaitGroup // goroutines feeding recvChan, and the writers of the tcp connections
+	writers sync.WaitGroup // goroutines consuming sendChan
+
+	done     chan struct{} // closed when shutting down
+	abort    chan struct{} // closed when the shutdown deadline exceeds
+	ctx      context.Context
+	cancel   context.CancelFunc // cancels the in-flight queries when aborting
+	doneOnce sync.Once
+	dropped  int64 // queries dropped by aborting, or not replied when shutting down
 }
 
-var defaultServer *server
+// NewServer creates a dnsproxy server with the config.
+func NewServer(cfg *Config) (*Server, error) {
+	if cfg == nil {
+		return nil, ErrInvalidConfig
+	}
+	cfg.check()
+	proxies, err := parseCIDRs(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := NewProxy(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		config: cfg,
+		proxy:  proxy,
 
-// Start starts to run dnsproxy-server.
-func Start(cfg *Config) error {
-	laddr, err := net.ResolveUDPAddr("udp", cfg.Addr)
+		trustedProxies: proxies,
+		recvChan:       make(chan *userPacket, cfg.WorkerPoolMax),
+		sendChan:       make(chan *userPacket, cfg.WorkerPoolMax),
+		done:           make(chan struct{}),
+		abort:          make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s, nil
+}
+
+// ListenAndServe listens on the config's Addr with UDP and TCP,
+// and serves until ctx is done or the server is shut down.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	if err := s.listen(); err != nil {
+		s.proxy.Close()
+		return err
+	}
+	s.start()
+
+	select {
+	case <-ctx.Done():
+		s.Shutdown(context.Background())
+		return ctx.Err()
+	case <-s.done:
+		return ErrServerClosed
+	}
+}
+
+// Proxy gets the server's core, to resolve the queries in process.
+func (s *Server) Proxy() *Proxy {
+	return s.proxy
+}
+
+// Addr gets the address the server listens on.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lconn == nil {
+		return nil
+	}
+	return s.lconn.LocalAddr()
+}
+
+// Shutdown shuts the server down gracefully. It stops accepting queries,
+// waits for the queued queries to be resolved and responded until ctx is
+// done, then drops the rest and reports how many queries are dropped.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var err error
+	s.doneOnce.Do(func() {
+		err = s.shutdown(ctx)
+	})
+	return err
+}
+
+// listen listens on the addresses, unless the server is shut down.
+func (s *Server) listen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed() {
+		return ErrServerClosed
+	}
+
+	laddr, err := net.ResolveUDPAddr("udp", s.config.Addr)
 	if err != nil {
 		return err
 	}
@@ -56,24 +311,165 @@ func Start(cfg *Config) error {
 	if err != nil {
 		return err
 	}
+	// listen tcp on the same port, if the port is picked by the system
+	taddr := &net.TCPAddr{IP: laddr.IP, Port: conn.LocalAddr().(*net.UDPAddr).Port, Zone: laddr.Zone}
+	tlisten, err := net.ListenTCP("tcp", taddr)
+	if err != nil {
+		conn.Close()
+		return err
+	}
 
-	cfg.check()
-	s := &server{
-		lconn:    conn,
-		config:   cfg,
-		recvChan: make(chan *userPacket, cfg.WorkerPoolMax),
-		sendChan: make(chan *userPacket, cfg.WorkerPoolMax),
+	if s.config.HTTPSAddr != "" || s.config.TLSAddr != "" {
+		if err := s.listenTLS(); err != nil {
+			conn.Close()
+			tlisten.Close()
+			return err
+		}
 	}
-	s.pool = newWorkerPool(s)
 
-	if cfg.WithCache {
-		s.cache = NewTrie()
-		s.cacheChan = make(chan *dns.Msg, cfg.WorkerPoolMax)
-		go s.cacheMsg()
+	s.lconn, s.tlisten = conn, tlisten
+	return nil
+}
+
+// start starts the goroutines serving the listeners, unless the server
+// is shut down.
+func (s *Server) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed() {
+		return
 	}
+	s.pool = newWorkerPool(s)
 
+	s.writers.Add(1)
 	go s.response()
+
+	s.readers.Add(2)
 	go s.run()
+	go s.runTCP(s.tlisten)
+	if s.dlisten != nil {
+		s.readers.Add(1)
+		go s.runTCP(s.dlisten)
+	}
+
+	if s.hlisten != nil {
+		go s.hserver.ServeTLS(s.hlisten, "", "")
+	}
+}
+
+func (s *Server) shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	close(s.done)
+	started := s.pool != nil
+	if !started && s.lconn != nil {
+		// close the listeners opened without serving
+		s.lconn.Close()
+		s.tlisten.Close()
+		if s.dlisten != nil {
+			s.dlisten.Close()
+		}
+		if s.hlisten != nil {
+			s.hlisten.Close()
+		}
+	}
+	s.mu.Unlock()
+	defer s.cancel()
+	if !started {
+		return s.proxy.Close()
+	}
+
+	// stop accepting queries, the udp conn is closed after the replies
+	s.lconn.SetReadDeadline(time.Now())
+	s.tlisten.Close()
+	if s.dlisten != nil {
+		s.dlisten.Close()
+	}
+	s.tconns.Range(func(k, _ interface{}) bool {
+		k.(*tcpConn).conn.SetReadDeadline(time.Now())
+		return true
+	})
+	if s.hserver != nil {
+		// wait for the https queries to be responded
+		s.hserver.Shutdown(ctx)
+	}
+
+	aborted := false
+	abort := func() {
+		if !aborted {
+			aborted = true
+			close(s.abort)
+			s.cancel() // interrupt the in-flight queries
+		}
+	}
+	read := make(chan struct{})
+	go func() {
+		s.readers.Wait()
+		close(read)
+	}()
+	select {
+	case <-read:
+	case <-ctx.Done():
+		abort()
+		s.closeTCPConns()
+	}
+
+	// let the workers drain the queued queries
+	s.recvMu.Lock()
+	s.recvClosed = true
+	close(s.recvChan)
+	s.recvMu.Unlock()
+	drained := make(chan struct{})
+	go func() {
+		s.pool.wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		abort()
+		<-drained
+	}
+
+	// flush the pending replies and cache writes
+	close(s.sendChan)
+	s.writers.Wait()
+	s.lconn.Close()
+	err := s.proxy.Close()
+
+	<-read
+	s.closeTCPConns()
+
+	if n := atomic.LoadInt64(&s.dropped); n > 0 {
+		if ctx.Err() == nil {
+			return fmt.Errorf("dnsproxy: %d queries dropped", n)
+		}
+		return fmt.Errorf("dnsproxy: %d queries dropped: %w", n, ctx.Err())
+	}
+	return err
+}
+
+// closeTCPConns closes the clients' tcp connections.
+func (s *Server) closeTCPConns() {
+	s.tconns.Range(func(k, _ interface{}) bool {
+		k.(*tcpConn).conn.Close()
+		s.tconns.Delete(k)
+		return true
+	})
+}
+
+var defaultServer *Server
+
+// Start starts to run dnsproxy-server.
+func Start(cfg *Config) error {
+	s, err := NewServer(cfg)
+	if err != nil {
+		return err
+	}
+	if err := s.listen(); err != nil {
+		s.proxy.Close()
+		return err
+	}
+	s.start()
 
 	defaultServer = s
 	return nil
@@ -82,62 +478,235 @@ func Start(cfg *Config) error {
 // Close closes the running dnsproxy
 func Close() error {
 	if defaultServer != nil {
-		defaultServer.close()
+		return defaultServer.Shutdown(context.Background())
 	}
 	return nil
 }
 
-func (s *server) run() {
+func (s *Server) run() {
+	defer s.readers.Done()
 	for {
-		data := make([]byte, 512)
-		s.lconn.SetDeadline(time.Now().Add(time.Second))
+		data := make([]byte, s.config.UDPMaxSize)
+		s.lconn.SetReadDeadline(time.Now().Add(time.Second))
+		if s.isClosed() { // shutdown may set the deadline before
+			return
+		}
 		n, raddr, err := s.lconn.ReadFromUDP(data)
-		if err == io.EOF {
+		if err == io.EOF || s.isClosed() {
 			return
 		}
 		if err != nil || raddr == nil {
 			continue
 		}
-		s.recv(data[:n], raddr)
+		s.recv(&userPacket{data: data[:n], addr: raddr})
+	}
+}
+
+func (s *Server) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) isAborted() bool {
+	select {
+	case <-s.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+// runTCP accepts the connections of DNS over TCP or TLS.
+func (s *Server) runTCP(l net.Listener) {
+	defer s.readers.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() && !s.isClosed() {
+				continue
+			}
+			return
+		}
+		tc := newTCPConn(conn)
+		s.tconns.Store(tc, struct{}{})
+		s.readers.Add(2)
+		go s.serveTCP(tc)
+		go s.writeTCP(tc)
 	}
 }
 
-func (s *server) recv(data []byte, raddr *net.UDPAddr) {
-	s.recvChan <- &userPacket{data: data, addr: raddr}
+// serveTCP reads the length-prefixed queries (RFC 7766) of a client's
+// connection. The queries are resolved concurrently by the worker pool,
+// so that the responses are written back in the order they are resolved.
+func (s *Server) serveTCP(tc *tcpConn) {
+	defer s.readers.Done()
+	defer tc.release() // the writer closes the conn after the replies
+
+	header := make([]byte, 2)
+	for {
+		tc.conn.SetReadDeadline(time.Now().Add(s.config.TCPIdleTimeout))
+		if s.isClosed() { // shutdown may set the deadline before
+			return
+		}
+		n, err := io.ReadFull(tc.conn, header)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && tc.busy() {
+			if n == 0 {
+				// keep the connection while its queries are in flight
+				continue
+			}
+			// finish reading the partial length, not to lose the framing
+			tc.conn.SetReadDeadline(time.Now().Add(s.config.TCPIdleTimeout))
+			if s.isClosed() {
+				return
+			}
+			_, err = io.ReadFull(tc.conn, header[n:])
+		}
+		if err != nil {
+			return
+		}
+
+		data := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(tc.conn, data); err != nil {
+			return
+		}
+		tc.acquire()
+		s.recv(&userPacket{data: data, addr: tc.conn.RemoteAddr(), conn: tc})
+	}
+}
+
+// writeTCP writes the replies of a client's connection, and closes it once
+// its reader quits and its queries are responded. The connection is closed
+// if failed to write, and the rest replies are dropped.
+func (s *Server) writeTCP(tc *tcpConn) {
+	defer s.readers.Done()
+	defer func() {
+		s.tconns.Delete(tc)
+		tc.conn.Close()
+	}()
+
+	var err error
+	for p := range tc.replies {
+		if err == nil {
+			if err = tc.write(p.data); err == ErrHugePacket {
+				err = nil // only the reply is dropped
+			} else if err != nil {
+				tc.conn.Close() // stops the reader
+			}
+		}
+		if err != nil && s.isClosed() {
+			atomic.AddInt64(&s.dropped, 1) // not replied when shutting down
+		}
+		p.done()
+	}
+}
+
+func (s *Server) recv(pkt *userPacket) bool {
+	s.recvMu.RLock()
+	defer s.recvMu.RUnlock()
+	if s.recvClosed {
+		return false
+	}
+
+	select {
+	case s.recvChan <- pkt:
+	case <-s.abort: // not to block the shutdown by the full queue
+		atomic.AddInt64(&s.dropped, 1)
+		return false
+	}
 	if len(s.recvChan) > s.config.WorkerPoolMin {
 		s.pool.openOne()
 	} else if len(s.recvChan) < s.config.WorkerPoolMin {
 		s.pool.closeOne()
 	}
+	return true
 }
 
-func (s *server) response() {
+func (s *Server) response() {
+	defer s.writers.Done()
 	for {
 		p, ok := <-s.sendChan
 		if !ok {
 			return
 		}
-		s.lconn.WriteToUDP(p.data, p.addr)
+		var err error
+		switch {
+		case p.resp != nil:
+			p.resp <- p.data
+			p.done()
+		default:
+			_, err = s.lconn.WriteTo(p.data, p.addr)
+		}
+		if err != nil && s.isClosed() {
+			atomic.AddInt64(&s.dropped, 1) // not replied when shutting down
+		}
 	}
 }
 
-func (s *server) close() {
-	s.lconn.Close()
-	s.pool.close()
+// tcpConn is a client's tcp connection, whose replies are queued to its
+// own writer, so that a client not reading them blocks nobody else.
+type tcpConn struct {
+	conn    net.Conn
+	replies chan *userPacket // closed once all the refs are released
+	refs    int32            // the reader and the queries not responded yet
 }
 
-func (s *server) toCache(msg *dns.Msg) {
-	s.cacheChan <- msg
+func newTCPConn(conn net.Conn) *tcpConn {
+	return &tcpConn{
+		conn:    conn,
+		replies: make(chan *userPacket, maxTCPReplies),
+		refs:    1, // the reader
+	}
 }
-func (s *server) cacheMsg() {
-	for {
-		msg, ok := <-s.cacheChan
-		if !ok {
-			return
-		}
-		r, ok := NewRecord(msg)
-		if ok {
-			s.cache.Add(getQuetion(msg), r)
-		}
+
+// busy gets whether the queries of the conn are in flight,
+// called by its reader.
+func (tc *tcpConn) busy() bool {
+	return atomic.LoadInt32(&tc.refs) > 1
+}
+
+func (tc *tcpConn) acquire() {
+	atomic.AddInt32(&tc.refs, 1)
+}
+
+// release releases the reader or a responded query,
+// the writer quits once all are released.
+func (tc *tcpConn) release() {
+	if atomic.AddInt32(&tc.refs, -1) == 0 {
+		close(tc.replies)
+	}
+}
+
+// send queues the reply to the writer, or closes the conn if the client
+// does not read its replies.
+func (tc *tcpConn) send(p *userPacket) {
+	select {
+	case tc.replies <- p:
+	default:
+		tc.conn.Close()
+		p.done()
 	}
 }
+
+func (tc *tcpConn) write(data []byte) error {
+	if len(data) > maxTCPMsgSize {
+		return ErrHugePacket
+	}
+	buf := lengthPrefixed(data)
+
+	tc.conn.SetWriteDeadline(time.Now().Add(wait))
+	_, err := tc.conn.Write(buf)
+	return err
+}
+
+// lengthPrefixed prefixes the message with its two-octet length,
+// as DNS over TCP.
+func lengthPrefixed(data []byte) []byte {
+	buf := make([]byte, len(data)+2)
+	binary.BigEndian.PutUint16(buf[:2], uint16(len(data)))
+	copy(buf[2:], data)
+	return buf
+}
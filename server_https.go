@@ -0,0 +1,149 @@
+package dnsproxy
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const dohPath = "/dns-query"
+
+func (s *Server) listenHTTPS(certs *certReloader) error {
+	l, err := net.Listen("tcp", s.config.HTTPSAddr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, s.serveHTTPS)
+	s.hlisten = l
+	s.hserver = &http.Server{
+		Handler:   mux,
+		TLSConfig: &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12},
+		// drop the slow and idle clients like the tcp ones
+		ReadHeaderTimeout: s.config.TCPIdleTimeout,
+		ReadTimeout:       s.config.TCPIdleTimeout,
+		IdleTimeout:       s.config.TCPIdleTimeout,
+	}
+	return nil
+}
+
+// serveHTTPS serves the DNS-over-HTTPS (RFC 8484) queries with GET and POST.
+func (s *Server) serveHTTPS(w http.ResponseWriter, r *http.Request) {
+	var data []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		data, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dnsMessageType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err = io.ReadAll(io.LimitReader(r.Body, maxTCPMsgSize))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(data) == 0 {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+
+	pkt := &userPacket{data: data, addr: s.clientAddr(r), resp: make(chan []byte, 1)}
+	if !s.recv(pkt) {
+		http.Error(w, "server closed", http.StatusServiceUnavailable)
+		return
+	}
+
+	select {
+	case data, ok := <-pkt.resp:
+		if !ok {
+			http.Error(w, "invalid dns message", http.StatusBadRequest)
+			return
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(data); err == nil {
+			w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(minTTL(msg)), 10))
+		}
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(data)
+	case <-r.Context().Done():
+	}
+}
+
+// clientAddr gets the client's address of the request, which is the
+// nearest untrusted address in X-Forwarded-For if the request comes
+// from a trusted reverse proxy.
+func (s *Server) clientAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	if !s.isTrustedProxy(addr.IP) {
+		return addr
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		addr = &net.TCPAddr{IP: ip}
+		if !s.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return addr
+}
+
+func (s *Server) isTrustedProxy(ip net.IP) bool {
+	for _, n := range s.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses the IPs or CIDRs.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// minTTL gets the minimum ttl of the msg's RRs, except the OPT RR.
+func minTTL(msg *dns.Msg) uint32 {
+	var ttl uint32
+	found := false
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			h := rr.Header()
+			if h.Rrtype != dns.TypeOPT && (!found || h.Ttl < ttl) {
+				ttl, found = h.Ttl, true
+			}
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,111 @@
+package dnsproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// writeTestCert writes the certificate and its key as PEM files.
+func writeTestCert(t *testing.T, dir string, cert tls.Certificate) (certFile, keyFile string) {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestServerHTTPS(t *testing.T) {
+	pool, cert := newTestCA(t, "dns.example")
+	certFile, keyFile := writeTestCert(t, t.TempDir(), cert)
+	up := newTestUpstream(t, answerA("192.0.2.1"))
+	s := newTestServer(t, &Config{
+		UpServers: []string{up},
+		HTTPSAddr: "127.0.0.1:0",
+		CertFile:  certFile,
+		KeyFile:   keyFile,
+	})
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		u, _ := NewHTTPSUpstream(&HTTPSUpstreamConfig{
+			URL:     "https://" + s.hlisten.Addr().String() + dohPath,
+			Method:  method,
+			RootCAs: pool,
+		})
+		m := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+		r, err := u.Exchange(context.Background(), m)
+		if err != nil {
+			t.Fatalf("failed to query with %s: %v", method, err)
+		}
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+			t.Errorf("unexpected answer with %s: %v", method, r)
+		}
+	}
+}
+
+func TestServerHTTPSIdleTimeout(t *testing.T) {
+	_, cert := newTestCA(t, "dns.example")
+	certFile, keyFile := writeTestCert(t, t.TempDir(), cert)
+	s := newTestServer(t, &Config{
+		HTTPSAddr:      "127.0.0.1:0",
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		TCPIdleTimeout: 100 * time.Millisecond,
+	})
+
+	conn, err := net.Dial("tcp", s.hlisten.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("the idle connection is not closed: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("the idle connection is closed after %v", d)
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	proxies, _ := parseCIDRs([]string{"10.0.0.0/8", "192.0.2.1"})
+	s := &Server{trustedProxies: proxies}
+
+	cases := []struct {
+		remote, xff, want string
+	}{
+		{"198.51.100.1:1234", "203.0.113.1", "198.51.100.1:1234"},
+		{"192.0.2.1:1234", "203.0.113.1", "203.0.113.1:0"},
+		{"10.1.1.1:1234", "203.0.113.9, 203.0.113.1, 10.2.2.2", "203.0.113.1:0"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, dohPath, nil)
+		r.RemoteAddr = c.remote
+		r.Header.Set("X-Forwarded-For", c.xff)
+		if addr := s.clientAddr(r).String(); addr != c.want {
+			t.Errorf("got client %s from %s via %s, expected %s", addr, c.xff, c.remote, c.want)
+		}
+	}
+}
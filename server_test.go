@@ -0,0 +1,471 @@
+package dnsproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestServerShutdown(t *testing.T) {
+	var queries int32
+	up := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		time.Sleep(200 * time.Millisecond)
+		answerA("192.0.2.1")(w, r)
+	})
+	before := runtime.NumGoroutine()
+	s, err := NewServer(&Config{
+		Addr:          "127.0.0.1:0",
+		UpServers:     []string{"udp://" + up},
+		WorkerPoolMin: 2,
+		WorkerPoolMax: 4,
+		WithCache:     true,
+		CacheFile:     filepath.Join(t.TempDir(), "cache.json"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.listen(); err != nil {
+		t.Fatal(err)
+	}
+	s.start()
+
+	uconn, err := net.Dial("udp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uconn.Close()
+	uconn.Write([]byte("not a dns message"))
+
+	tconn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tconn.Close()
+	tconn.Write([]byte{0, 3, 'b', 'a', 'd'})
+
+	// the queries in flight are answered
+	answers := make(chan error, 2)
+	for _, network := range []string{"udp", "tcp"} {
+		go func(network string) {
+			c := &dns.Client{Net: network, Timeout: 2 * time.Second}
+			m := new(dns.Msg).SetQuestion(network+".example.", dns.TypeA)
+			r, _, err := c.Exchange(m, s.Addr().String())
+			if err == nil && len(r.Answer) != 1 {
+				err = fmt.Errorf("unexpected response over %s: %v", network, r)
+			}
+			answers <- err
+		}(network)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&queries) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the queries are not in flight")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("failed to shutdown: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-answers; err != nil {
+			t.Errorf("the query in flight is not answered: %v", err)
+		}
+	}
+
+	deadline = time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("goroutines leaked: %d > %d\n%s", runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerShutdownAbort(t *testing.T) {
+	up := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(time.Second)
+		answerA("192.0.2.1")(w, r)
+	})
+	s, err := NewServer(&Config{
+		Addr:          "127.0.0.1:0",
+		UpServers:     []string{"udp://" + up},
+		WorkerPoolMin: 1,
+		WorkerPoolMax: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.listen(); err != nil {
+		t.Fatal(err)
+	}
+	s.start()
+
+	// one query in flight, and the others queued
+	for i := 0; i < 3; i++ {
+		c := &dns.Client{Net: "udp", Timeout: 2 * time.Second}
+		m := new(dns.Msg).SetQuestion(fmt.Sprintf("%d.example.", i), dns.TypeA)
+		go c.Exchange(m, s.Addr().String())
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// the reader blocked by the full queue does not delay the shutdown
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("shutdown returns after %v, over its deadline", d)
+	}
+	if err == nil || !strings.Contains(err.Error(), "queries dropped") || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error of the aborted shutdown: %v", err)
+	}
+}
+
+func TestServerListenError(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	s, err := NewServer(&Config{Addr: pc.LocalAddr().String(), WithCache: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ListenAndServe(context.Background()); err == nil {
+		t.Fatal("listened on the address in use")
+	}
+	if !s.proxy.closed {
+		t.Error("the proxy is not closed")
+	}
+}
+
+// newTestUpstream runs a dns server on a random local udp and tcp port.
+func newTestUpstream(t *testing.T, handler dns.HandlerFunc) string {
+	var pc net.PacketConn
+	var l net.Listener
+	var err error
+	for i := 0; i < 10; i++ { // the tcp port may be in use
+		if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if l, err = net.Listen("tcp", pc.LocalAddr().String()); err == nil {
+			break
+		}
+		pc.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	us := &dns.Server{PacketConn: pc, Handler: handler}
+	ts := &dns.Server{Listener: l, Handler: handler}
+	go us.ActivateAndServe()
+	go ts.ActivateAndServe()
+	t.Cleanup(func() {
+		us.Shutdown()
+		ts.Shutdown()
+	})
+	return pc.LocalAddr().String()
+}
+
+func answerA(ip string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		msg.RecursionAvailable = true
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A " + ip)
+		msg.Answer = append(msg.Answer, rr)
+		w.WriteMsg(msg)
+	}
+}
+
+func newTestServer(t *testing.T, cfg *Config) *Server {
+	if cfg.Addr == "" {
+		cfg.Addr = "127.0.0.1:0"
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.listen(); err != nil {
+		t.Fatal(err)
+	}
+	s.start()
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
+
+func TestServerProxy(t *testing.T) {
+	up := newTestUpstream(t, answerA("192.0.2.1"))
+	s := newTestServer(t, &Config{UpServers: []string{"udp://" + up}, WithCache: true})
+
+	for _, network := range []string{"udp", "tcp"} {
+		c := &dns.Client{Net: network}
+		m := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+		r, _, err := c.Exchange(m, s.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to query over %s: %v", network, err)
+		}
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+			t.Fatalf("unexpected answer over %s: %v", network, r)
+		}
+	}
+}
+
+func TestServerTruncate(t *testing.T) {
+	up := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		for i := 1; i <= 100; i++ {
+			rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN A 192.0.2.%d", r.Question[0].Name, i))
+			msg.Answer = append(msg.Answer, rr)
+		}
+		if w.RemoteAddr().Network() == "udp" {
+			msg.Truncate(dns.MinMsgSize)
+		}
+		w.WriteMsg(msg)
+	})
+	s := newTestServer(t, &Config{UpServers: []string{"udp://" + up}})
+
+	c := &dns.Client{Net: "udp", UDPSize: 4096}
+	m := new(dns.Msg).SetQuestion("big.example.", dns.TypeA)
+	r, _, err := c.Exchange(m, s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Compress = true
+	if !r.Truncated || r.Len() > dns.MinMsgSize {
+		t.Errorf("oversized response without EDNS0: TC %v, %d bytes", r.Truncated, r.Len())
+	}
+
+	m.SetEdns0(4096, false)
+	r, _, err = c.Exchange(m, s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Truncated || len(r.Answer) != 100 {
+		t.Errorf("truncated response with EDNS0: TC %v, %d answers", r.Truncated, len(r.Answer))
+	}
+}
+
+func TestServerTCPPipelining(t *testing.T) {
+	up := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "slow.example." {
+			time.Sleep(300 * time.Millisecond)
+		}
+		answerA("192.0.2.1")(w, r)
+	})
+	s := newTestServer(t, &Config{UpServers: []string{"udp://" + up}, WorkerPoolMin: 4, WorkerPoolMax: 8})
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the queries are written back-to-back, the slow one first
+	names := map[uint16]string{1: "slow.example.", 2: "a.example.", 3: "b.example."}
+	var buf []byte
+	for id := uint16(1); id <= 3; id++ {
+		m := new(dns.Msg).SetQuestion(names[id], dns.TypeA)
+		m.Id = id
+		data, _ := m.Pack()
+		buf = append(buf, lengthPrefixed(data)...)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the replies are framed and matched by the ids, the slow one last
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	dc := &dns.Conn{Conn: conn}
+	var ids []uint16
+	for i := 0; i < 3; i++ {
+		r, err := dc.ReadMsg()
+		if err != nil {
+			t.Fatalf("failed to read the reply %d: %v", i, err)
+		}
+		if len(r.Answer) != 1 || r.Question[0].Name != names[r.Id] {
+			t.Errorf("unexpected reply of id %d: %v", r.Id, r)
+		}
+		ids = append(ids, r.Id)
+	}
+	if ids[2] != 1 {
+		t.Errorf("the replies are in order %v, expected the slow one last", ids)
+	}
+}
+
+func TestServerTCPPartialLength(t *testing.T) {
+	up := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "slow.example." {
+			time.Sleep(300 * time.Millisecond)
+		}
+		answerA("192.0.2.1")(w, r)
+	})
+	s := newTestServer(t, &Config{UpServers: []string{"udp://" + up}, TCPIdleTimeout: 100 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the read of the next length times out after its first byte,
+	// while the slow query is in flight
+	var bufs [][]byte
+	for id, name := range []string{"slow.example.", "a.example."} {
+		m := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		m.Id = uint16(id + 1)
+		data, _ := m.Pack()
+		bufs = append(bufs, lengthPrefixed(data))
+	}
+	for _, buf := range [][]byte{append(bufs[0], bufs[1][0]), bufs[1][1:]} {
+		if _, err := conn.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(150 * time.Millisecond)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	dc := &dns.Conn{Conn: conn}
+	for i := 0; i < 2; i++ {
+		r, err := dc.ReadMsg()
+		if err != nil {
+			t.Fatalf("failed to read the reply %d: %v", i, err)
+		}
+		if len(r.Answer) != 1 {
+			t.Errorf("unexpected reply: %v", r)
+		}
+	}
+}
+
+func TestServerTCPUnreadReplies(t *testing.T) {
+	up := newTestUpstream(t, answerA("192.0.2.1"))
+	s := newTestServer(t, &Config{UpServers: []string{"udp://" + up}, WithCache: true})
+
+	// the client pipelines the queries but never reads the replies
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+	data, _ := m.Pack()
+	var buf []byte
+	for i := 0; i < 300000; i++ {
+		buf = append(buf, lengthPrefixed(data)...)
+	}
+	go conn.Write(buf)
+
+	c := &dns.Client{Timeout: time.Second}
+	for i := 0; i < 5; i++ {
+		time.Sleep(300 * time.Millisecond)
+		if _, _, err := c.Exchange(new(dns.Msg).SetQuestion("a.example.", dns.TypeA), s.Addr().String()); err != nil {
+			t.Fatalf("the udp query is blocked by the tcp client: %v", err)
+		}
+	}
+}
+
+func TestServerTCPIdleTimeout(t *testing.T) {
+	s := newTestServer(t, &Config{TCPIdleTimeout: 100 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("the idle connection is not closed: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("the idle connection is closed after %v", d)
+	}
+}
+
+func TestServerShutdownRace(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		s, err := NewServer(&Config{Addr: "127.0.0.1:0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		errc := make(chan error, 1)
+		go func() { errc <- s.ListenAndServe(context.Background()) }()
+		if i%2 == 1 {
+			time.Sleep(time.Millisecond)
+		}
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Fatalf("failed to shutdown: %v", err)
+		}
+		if err := <-errc; err != ErrServerClosed {
+			t.Errorf("unexpected error of ListenAndServe: %v", err)
+		}
+
+		// the address is released
+		if addr := s.Addr(); addr != nil {
+			conn, err := net.ListenUDP("udp", addr.(*net.UDPAddr))
+			if err != nil {
+				t.Fatalf("the address is not released: %v", err)
+			}
+			conn.Close()
+		}
+	}
+}
+
+func TestServerSideBySide(t *testing.T) {
+	servers := make([]*Server, 2)
+	errcs := make([]chan error, 2)
+	for i := range servers {
+		up := newTestUpstream(t, answerA(fmt.Sprintf("192.0.2.%d", i+1)))
+		s, err := NewServer(&Config{Addr: "127.0.0.1:0", UpServers: []string{"udp://" + up}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers[i], errcs[i] = s, make(chan error, 1)
+		go func(s *Server, errc chan error) { errc <- s.ListenAndServe(context.Background()) }(s, errcs[i])
+	}
+
+	for i, s := range servers {
+		deadline := time.Now().Add(2 * time.Second)
+		for s.Addr() == nil {
+			if time.Now().After(deadline) {
+				t.Fatal("the server is not listening")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		m := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+		r, _, err := new(dns.Client).Exchange(m, s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := fmt.Sprintf("192.0.2.%d", i+1); len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != expected {
+			t.Errorf("unexpected answer of server %d: %v, expected %s", i, r, expected)
+		}
+	}
+
+	for i, s := range servers {
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Errorf("failed to shutdown server %d: %v", i, err)
+		}
+		if err := <-errcs[i]; err != ErrServerClosed {
+			t.Errorf("unexpected error of server %d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package dnsproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const certCheckInterval = time.Second * 10 // interval to check the certificate files
+
+// listenTLS listens on the DNS-over-HTTPS and DNS-over-TLS addresses.
+func (s *Server) listenTLS() error {
+	if s.config.CertFile == "" || s.config.KeyFile == "" {
+		return ErrInvalidConfig
+	}
+	certs, err := newCertReloader(s.config.CertFile, s.config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	if s.config.TLSAddr != "" {
+		tlsConfig := &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+		if s.config.ClientCAFile != "" {
+			pem, err := os.ReadFile(s.config.ClientCAFile)
+			if err != nil {
+				return err
+			}
+			tlsConfig.ClientCAs = x509.NewCertPool()
+			if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+				return ErrInvalidCA
+			}
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		l, err := net.Listen("tcp", s.config.TLSAddr)
+		if err != nil {
+			return err
+		}
+		s.dlisten = tls.NewListener(l, tlsConfig)
+	}
+
+	if s.config.HTTPSAddr != "" {
+		if err := s.listenHTTPS(certs); err != nil {
+			if s.dlisten != nil {
+				s.dlisten.Close()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// certReloader keeps the certificate loaded from the files,
+// and reloads it once the files are modified.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate gets the certificate for tls.Config.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) > certCheckInterval {
+		// keep the old certificate if the new one is broken
+		c.reload()
+	}
+	return c.cert, nil
+}
+
+func (c *certReloader) reload() error {
+	c.checked = time.Now()
+	modTime, err := c.lastModified()
+	if err != nil || !modTime.After(c.modTime) {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert, c.modTime = &cert, modTime
+	return nil
+}
+
+func (c *certReloader) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, fp := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(fp)
+		if err != nil {
+			return last, err
+		}
+		if fi.ModTime().After(last) {
+			last = fi.ModTime()
+		}
+	}
+	return last, nil
+}
@@ -0,0 +1,101 @@
+package dnsproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestServerTLS(t *testing.T) {
+	ca, pool, cert := newTestCACert(t, "dns.example")
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, cert)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600)
+
+	up := newTestUpstream(t, answerA("192.0.2.1"))
+	s := newTestServer(t, &Config{
+		UpServers:    []string{up},
+		TLSAddr:      "127.0.0.1:0",
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: caFile,
+	})
+	addr := s.dlisten.Addr().String()
+
+	// the client certificate is required
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "dns.example", RootCAs: pool})
+	if err == nil {
+		conn.SetDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err == nil {
+		t.Fatal("served the client without certificate")
+	}
+
+	conn, err = tls.Dial("tcp", addr, &tls.Config{
+		ServerName:   "dns.example",
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// pipeline the queries on the connection
+	ids := make(map[uint16]bool)
+	for _, name := range []string{"a.example.", "b.example.", "c.example."} {
+		m := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		data, _ := m.Pack()
+		conn.Write(append([]byte{byte(len(data) >> 8), byte(len(data))}, data...))
+		ids[m.Id] = true
+	}
+	for range ids {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(conn, data); err != nil {
+			t.Fatal(err)
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(data); err != nil || !ids[r.Id] || len(r.Answer) != 1 {
+			t.Fatalf("unexpected response: %v, err: %v", r, err)
+		}
+		delete(ids, r.Id)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	_, cert := newTestCA(t, "old.example")
+	certFile, keyFile := writeTestCert(t, dir, cert)
+	c, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, cert = newTestCA(t, "new.example")
+	writeTestCert(t, dir, cert)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	c.checked = time.Time{}
+
+	got, _ := c.GetCertificate(nil)
+	leaf, err := x509.ParseCertificate(got.Certificate[0])
+	if err != nil || leaf.Subject.CommonName != "new.example" {
+		t.Errorf("certificate is not reloaded, got %s", leaf.Subject.CommonName)
+	}
+}
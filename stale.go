@@ -0,0 +1,112 @@
+package dnsproxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultStaleAnswerTTL       = time.Second * 30
+	defaultStaleAnswerTimeout   = time.Millisecond * 1800 // client response timer of RFC 8767
+	defaultStaleRecheckInterval = time.Second * 30        // failure recheck timer of RFC 8767
+)
+
+// resolveStale gets the expired response to the query in the stale window,
+// whose TTLs are StaleAnswerTTL.
+func (p *Proxy) resolveStale(msg *dns.Msg) (*dns.Msg, bool) {
+	if p.config.CacheStaleWindow <= 0 {
+		return nil, false
+	}
+	_msg, ok := p.cachedResponse(msg, p.cache.GetStale)
+	if !ok {
+		return nil, false
+	}
+
+	ttl := uint32(p.config.StaleAnswerTTL / time.Second)
+	for _, rrs := range [][]dns.RR{_msg.Answer, _msg.Ns, _msg.Extra} {
+		for _, rr := range rrs {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT {
+				h.Ttl = ttl
+			}
+		}
+	}
+	return _msg, true
+}
+
+// serveStale refreshes the stale response of the query with the next
+// handler, and responds the stale one if the refresh fails or does not
+// respond in StaleAnswerTimeout. The queries of a key being refreshed, or
+// failed to be refreshed in StaleRecheckInterval, are responded the stale
+// one directly.
+func (p *Proxy) serveStale(ctx context.Context, w ResponseWriter, r *dns.Msg, next Handler, stale *dns.Msg) {
+	if resp, ok := p.refresh(w, r, next); ok {
+		timer := time.NewTimer(p.config.StaleAnswerTimeout)
+		defer timer.Stop()
+		select {
+		case msg := <-resp:
+			if msg != nil && isValidAnswer(msg) {
+				w.WriteMsg(msg)
+				return
+			}
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+	w.WriteMsg(stale)
+}
+
+// refresh resolves the query with the next handler in the background and
+// caches the response, which is sent to the returned channel. It gets false
+// if the query of the same key is being refreshed, or failed to be refreshed
+// in StaleRecheckInterval, or the proxy is closed.
+func (p *Proxy) refresh(w ResponseWriter, r *dns.Msg, next Handler) (<-chan *dns.Msg, bool) {
+	key := getQuetion(r)
+	if v, ok := p.failed.Load(key); ok && time.Since(v.(time.Time)) < p.config.StaleRecheckInterval {
+		return nil, false
+	}
+	if _, loaded := p.refreshing.LoadOrStore(key, struct{}{}); loaded {
+		return nil, false
+	}
+	p.cacheMu.RLock()
+	closed := p.closed
+	if !closed {
+		p.writers.Add(1) // before Close waits for the writers
+	}
+	p.cacheMu.RUnlock()
+	if closed {
+		p.refreshing.Delete(key)
+		return nil, false
+	}
+
+	r = r.Copy()
+	resp := make(chan *dns.Msg, 1)
+	go func() {
+		defer p.writers.Done()
+		defer close(resp)
+		// not canceled with the client's query, but with the proxy
+		ctx, cancel := context.WithTimeout(p.ctx, timeout)
+		defer cancel()
+
+		var msg *dns.Msg
+		next.ServeDNS(ctx, &responseWriterFunc{
+			ResponseWriter: w,
+			write: func(m *dns.Msg) error {
+				p.cacheResponse(r, m)
+				msg = m
+				return nil
+			},
+		}, r)
+		if msg != nil && isValidAnswer(msg) {
+			p.failed.Delete(key)
+		} else {
+			p.failed.Store(key, time.Now())
+		}
+		p.refreshing.Delete(key)
+		if msg != nil {
+			resp <- msg
+		}
+	}()
+	return resp, true
+}
@@ -0,0 +1,135 @@
+package dnsproxy
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestProxyServeStale(t *testing.T) {
+	var queries, mode int32 // mode 0: answer, 1: SERVFAIL, 2: slow answer
+	up := newTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		msg := new(dns.Msg).SetReply(r)
+		switch atomic.LoadInt32(&mode) {
+		case 1:
+			msg.Rcode = dns.RcodeServerFailure
+		case 2:
+			time.Sleep(200 * time.Millisecond)
+			fallthrough
+		default:
+			rr, _ := dns.NewRR("www.example. 60 IN A 192.0.2.2")
+			msg.Answer = append(msg.Answer, rr)
+		}
+		w.WriteMsg(msg)
+	})
+	before := runtime.NumGoroutine()
+	p, err := NewProxy(&Config{
+		UpServers:            []string{up},
+		WithCache:            true,
+		CacheStaleWindow:     time.Hour,
+		StaleAnswerTimeout:   50 * time.Millisecond,
+		StaleRecheckInterval: 300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	expire := func() {
+		r := newTestRecord("www.example.")
+		r.Expired = time.Now().Add(-time.Minute)
+		p.cache.Add("a.www.example.", r)
+	}
+	exchange := func() *dns.Msg {
+		r, err := p.Exchange(context.Background(), new(dns.Msg).SetQuestion("www.example.", dns.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	refreshed := func() {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			if r, ok := p.cache.Get("a.www.example."); ok && r.Msg.Answer[0].(*dns.A).A.String() == "192.0.2.2" {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("the stale record is not refreshed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	isStale := func(r *dns.Msg) bool {
+		return len(r.Answer) == 1 && r.Answer[0].(*dns.A).A.String() == "192.0.2.1" &&
+			r.Answer[0].Header().Ttl == uint32(defaultStaleAnswerTTL/time.Second)
+	}
+
+	// the up server fails, the stale record is served and not refreshed
+	// again until the recheck interval passes
+	expire()
+	atomic.StoreInt32(&mode, 1)
+	if r := exchange(); r.Rcode != dns.RcodeSuccess || !isStale(r) {
+		t.Errorf("unexpected response: %v", r)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := p.refreshing.Load("a.www.example."); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the failed refresh is not done")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		if r := exchange(); !isStale(r) {
+			t.Errorf("unexpected response: %v", r)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("queried the up server %d times in the recheck interval, expected 1", n)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	// the up server is slow, the stale record is served and refreshed
+	atomic.StoreInt32(&mode, 2)
+	if r := exchange(); !isStale(r) {
+		t.Errorf("unexpected response: %v", r)
+	}
+	refreshed()
+
+	// the up server answers in time
+	expire()
+	atomic.StoreInt32(&mode, 0)
+	if r := exchange(); len(r.Answer) != 1 || r.Answer[0].Header().Ttl != 60 {
+		t.Errorf("unexpected response: %v", r)
+	}
+	refreshed()
+
+	// the refresh in flight is waited by Close, without leaking
+	expire()
+	atomic.StoreInt32(&mode, 2)
+	if r := exchange(); !isStale(r) {
+		t.Errorf("unexpected response: %v", r)
+	}
+	if _, ok := p.refreshing.Load("a.www.example."); !ok {
+		t.Error("the stale record is not being refreshed")
+	}
+	p.Close()
+	if _, ok := p.refreshing.Load("a.www.example."); ok {
+		t.Error("the refresh outlives Close")
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("goroutines leaked: %d > %d\n%s", runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
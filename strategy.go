@@ -0,0 +1,238 @@
+package dnsproxy
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// strategies to select the up dns servers
+const (
+	// StrategySequential tries the up servers in order
+	StrategySequential = "sequential"
+	// StrategyRoundRobin starts with the up servers in turn
+	StrategyRoundRobin = "round_robin"
+	// StrategyWeightedRandom starts with a random up server by weight
+	StrategyWeightedRandom = "weighted_random"
+	// StrategyFastest starts with the up server of the least EWMA RTT
+	StrategyFastest = "fastest"
+	// StrategyParallel queries all the up servers at once,
+	// and takes the first valid answer
+	StrategyParallel = "parallel"
+)
+
+const rttDecay = 0.3 // weight of the latest rtt in the EWMA rtt
+
+// upstreamGroup selects the up dns servers with the strategy.
+type upstreamGroup struct {
+	strategy string
+	ups      []*upstreamStat
+	probing  bool // whether the down up servers are probed actively
+	logger   *log.Logger
+
+	next uint32 // for round robin
+}
+
+// upstreamStat is an up dns server with its weight, EWMA rtt and health.
+type upstreamStat struct {
+	Upstream
+	health
+
+	group  *upstreamGroup
+	weight int
+	rtt    int64 // nanoseconds
+}
+
+func newUpstreamGroup(strategy string, ups []Upstream, weights []int) (*upstreamGroup, error) {
+	switch strategy {
+	case "":
+		strategy = StrategySequential
+	case StrategySequential, StrategyRoundRobin, StrategyWeightedRandom,
+		StrategyFastest, StrategyParallel:
+	default:
+		return nil, ErrInvalidStrategy
+	}
+
+	g := &upstreamGroup{strategy: strategy, ups: make([]*upstreamStat, len(ups))}
+	for i, u := range ups {
+		weight := 1
+		if i < len(weights) && weights[i] > 0 {
+			weight = weights[i]
+		}
+		g.ups[i] = &upstreamStat{Upstream: u, group: g, weight: weight}
+	}
+	return g, nil
+}
+
+// exchange exchanges the msg with the up servers by the strategy,
+// each up server is given `wait` to respond.
+func (g *upstreamGroup) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if len(g.ups) == 0 {
+		return nil, ErrNotFound
+	}
+	if g.strategy == StrategyParallel {
+		return g.race(ctx, msg)
+	}
+
+	var invalid *dns.Msg // the failure of the up servers, e.g. SERVFAIL
+	err := ErrNotFound
+	ups, all := g.order()
+	for _, u := range ups {
+		if !all && !u.try(g.probing) {
+			continue
+		}
+		var _msg *dns.Msg
+		if _msg, err = u.exchange(ctx, msg); err == nil {
+			if isValidAnswer(_msg) {
+				return _msg, nil
+			}
+			invalid = _msg
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if invalid != nil {
+		return invalid, nil
+	}
+	return nil, err
+}
+
+// order gets the order to try the available up servers, or all the up
+// servers if none is available, which is reported by all.
+func (g *upstreamGroup) order() (ups []*upstreamStat, all bool) {
+	ups = make([]*upstreamStat, 0, len(g.ups))
+	for _, u := range g.ups {
+		if u.available(g.probing) {
+			ups = append(ups, u)
+		}
+	}
+	if len(ups) == 0 {
+		ups, all = append(ups, g.ups...), true
+	}
+
+	switch g.strategy {
+	case StrategyRoundRobin:
+		n := int((atomic.AddUint32(&g.next, 1) - 1) % uint32(len(ups)))
+		ups = append(ups[n:], ups[:n]...)
+	case StrategyWeightedRandom:
+		// pick the up servers one by one by weight
+		for i := range ups {
+			total := 0
+			for _, u := range ups[i:] {
+				total += u.weight
+			}
+			n := rand.Intn(total)
+			for j, u := range ups[i:] {
+				if n -= u.weight; n < 0 {
+					ups[i], ups[i+j] = ups[i+j], ups[i]
+					break
+				}
+			}
+		}
+	case StrategyFastest:
+		sort.SliceStable(ups, func(i, j int) bool {
+			return atomic.LoadInt64(&ups[i].rtt) < atomic.LoadInt64(&ups[j].rtt)
+		})
+	}
+	return ups, all
+}
+
+// race queries all the up servers, and takes the first valid answer.
+func (g *upstreamGroup) race(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		msg *dns.Msg
+		err error
+	}
+	ups, all := g.order()
+	if !all {
+		tried := ups[:0]
+		for _, u := range ups {
+			if u.try(g.probing) {
+				tried = append(tried, u)
+			}
+		}
+		ups = tried
+	}
+	if len(ups) == 0 {
+		return nil, ErrNotFound
+	}
+	results := make(chan result, len(ups))
+	for _, u := range ups {
+		go func(u *upstreamStat) {
+			_msg, err := u.exchange(ctx, msg.Copy())
+			results <- result{_msg, err}
+		}(u)
+	}
+
+	var invalid *dns.Msg
+	var err error
+	for range ups {
+		res := <-results
+		if res.err != nil {
+			err = res.err
+			continue
+		}
+		if isValidAnswer(res.msg) {
+			return res.msg, nil
+		}
+		invalid = res.msg
+	}
+	if invalid != nil {
+		return invalid, nil
+	}
+	return nil, err
+}
+
+// isValidAnswer gets whether the msg is an answer but not a failure
+// of the up server.
+func isValidAnswer(msg *dns.Msg) bool {
+	return msg.Rcode != dns.RcodeServerFailure && msg.Rcode != dns.RcodeRefused
+}
+
+func (u *upstreamStat) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	start := time.Now()
+	_msg, err := u.Exchange(ctx, msg)
+	if err != nil && parent.Err() != nil {
+		// canceled by the caller, e.g. another up server wins the race
+		u.endTrial()
+		return nil, err
+	}
+
+	rtt := time.Since(start)
+	if err != nil {
+		rtt = wait // penalize the failure
+		u.recordFailure(err)
+	} else {
+		// SERVFAIL or REFUSED may be of a broken domain but not the up
+		// server, so it stays up while the caller tries the next one
+		u.recordSuccess()
+	}
+	u.observe(rtt)
+	return _msg, err
+}
+
+func (u *upstreamStat) observe(rtt time.Duration) {
+	for {
+		old := atomic.LoadInt64(&u.rtt)
+		ewma := int64(rtt)
+		if old != 0 {
+			ewma = int64(rttDecay*float64(rtt) + (1-rttDecay)*float64(old))
+		}
+		if atomic.CompareAndSwapInt64(&u.rtt, old, ewma) {
+			return
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package dnsproxy
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeUpstream answers after the delay with the rcode, and counts the queries.
+type fakeUpstream struct {
+	delay   time.Duration
+	rcode   int
+	queries int32
+	failing int32 // fails the queries if not 0
+}
+
+func (u *fakeUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&u.queries, 1)
+	select {
+	case <-time.After(u.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if atomic.LoadInt32(&u.failing) != 0 {
+		return nil, ErrServerFailed
+	}
+	return new(dns.Msg).SetRcode(msg, u.rcode), nil
+}
+
+func testGroup(t *testing.T, strategy string, weights []int, ups ...*fakeUpstream) *upstreamGroup {
+	list := make([]Upstream, len(ups))
+	for i, u := range ups {
+		list[i] = u
+	}
+	g, err := newUpstreamGroup(strategy, list, weights)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestStrategies(t *testing.T) {
+	m := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+	ctx := context.Background()
+
+	a, b := &fakeUpstream{}, &fakeUpstream{}
+	g := testGroup(t, StrategyRoundRobin, nil, a, b)
+	for i := 0; i < 10; i++ {
+		g.exchange(ctx, m)
+	}
+	if a.queries != 5 || b.queries != 5 {
+		t.Errorf("round_robin: %d and %d queries", a.queries, b.queries)
+	}
+
+	a, b = &fakeUpstream{}, &fakeUpstream{}
+	g = testGroup(t, StrategyWeightedRandom, []int{9, 1}, a, b)
+	for i := 0; i < 1000; i++ {
+		g.exchange(ctx, m)
+	}
+	if a.queries < 800 || b.queries < 50 {
+		t.Errorf("weighted_random: %d and %d queries by weights 9:1", a.queries, b.queries)
+	}
+
+	slow, fast := &fakeUpstream{delay: 20 * time.Millisecond}, &fakeUpstream{}
+	g = testGroup(t, StrategyFastest, nil, slow, fast)
+	for i := 0; i < 10; i++ {
+		g.exchange(ctx, m)
+	}
+	if slow.queries > 2 {
+		t.Errorf("fastest: %d queries to the slow one", slow.queries)
+	}
+
+	failed, slow := &fakeUpstream{rcode: dns.RcodeServerFailure}, &fakeUpstream{delay: 20 * time.Millisecond}
+	g = testGroup(t, StrategyParallel, nil, failed, slow)
+	if r, err := g.exchange(ctx, m); err != nil || r.Rcode != dns.RcodeSuccess {
+		t.Errorf("parallel: %v, err: %v", r, err)
+	}
+
+	// the failures of the up servers fall back to the next ones
+	for _, strategy := range []string{StrategySequential, StrategyRoundRobin, StrategyFastest} {
+		bad, good := &fakeUpstream{rcode: dns.RcodeServerFailure}, &fakeUpstream{}
+		g = testGroup(t, strategy, nil, bad, good)
+		for i := 0; i < 5; i++ {
+			if r, err := g.exchange(ctx, m); err != nil || r.Rcode != dns.RcodeSuccess {
+				t.Errorf("%s: %v, err: %v", strategy, r, err)
+			}
+		}
+		if hs := g.health(); !hs[0].Healthy || hs[0].Failures != 0 {
+			t.Errorf("%s: the SERVFAIL upstream is counted as failures: %+v", strategy, hs[0])
+		}
+	}
+
+	// the failure is responded if all the up servers fail
+	g = testGroup(t, StrategySequential, nil, &fakeUpstream{rcode: dns.RcodeRefused}, &fakeUpstream{failing: 1})
+	if r, err := g.exchange(ctx, m); err != nil || r.Rcode != dns.RcodeRefused {
+		t.Errorf("sequential: %v, err: %v", r, err)
+	}
+
+	if _, err := newUpstreamGroup("unknown", nil, nil); err != ErrInvalidStrategy {
+		t.Errorf("accepted unknown strategy, err: %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package dnsproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream is an up dns server which the queries are proxied to.
+// It must be safe for concurrent use.
+type Upstream interface {
+	Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+}
+
+// ParseUpstream parses an up dns server spec to Upstream,
+// the spec is like:
+//
+//	8.8.8.8
+//	udp://1.1.1.1:5353
+//	tcp://[2001:db8::1]
+//	tls://dns.example:853
+//	tls://1.1.1.1?sni=cloudflare-dns.com&pin=<base64 spki sha256>&ca=ca.pem
+//	https://dns.example/dns-query
+//	https://dns.example/dns-query{?dns}
+//
+// The default port is 53 for udp and tcp, and 853 for tls.
+// DNS-over-HTTPS queries are sent with POST, or GET if the url ends
+// with the URI template {?dns}.
+func ParseUpstream(spec string) (Upstream, error) {
+	if !strings.Contains(spec, "://") {
+		if ip := net.ParseIP(spec); ip != nil {
+			return newPlainUpstream("udp", net.JoinHostPort(spec, "53")), nil
+		}
+		spec = "udp://" + spec
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil || u.Hostname() == "" {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidUpstream, spec)
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		return newPlainUpstream(u.Scheme, hostPort(u, "53")), nil
+	case "tls":
+		q, err := parseRawQuery(u.RawQuery)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidUpstream, spec)
+		}
+		return NewTLSUpstream(&TLSUpstreamConfig{
+			Addr:       hostPort(u, "853"),
+			ServerName: q.Get("sni"),
+			SPKIPins:   q["pin"],
+			CAFile:     q.Get("ca"),
+		})
+	case "https":
+		return NewHTTPSUpstream(&HTTPSUpstreamConfig{URL: spec})
+	}
+	return nil, fmt.Errorf("%w: %s", ErrInvalidUpstream, spec)
+}
+
+// ParseUpstreams parses the up dns server specs.
+func ParseUpstreams(specs []string) ([]Upstream, error) {
+	ups := make([]Upstream, 0, len(specs))
+	for _, spec := range specs {
+		u, err := ParseUpstream(spec)
+		if err != nil {
+			return nil, err
+		}
+		ups = append(ups, u)
+	}
+	return ups, nil
+}
+
+func closeUpstreams(ups []Upstream) {
+	for _, u := range ups {
+		if c, ok := u.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// parseRawQuery parses the query of the upstream spec without form decoding,
+// which would turn the '+' of the base64 encoded pins into a space.
+func parseRawQuery(query string) (url.Values, error) {
+	q := make(url.Values)
+	for _, kv := range strings.Split(query, "&") {
+		if kv == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(kv, "=")
+		k, err := url.PathUnescape(k)
+		if err != nil {
+			return nil, err
+		}
+		if v, err = url.PathUnescape(v); err != nil {
+			return nil, err
+		}
+		q.Add(k, v)
+	}
+	return q, nil
+}
+
+func hostPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// plainUpstream is a cleartext dns server over udp or tcp.
+type plainUpstream struct {
+	network, addr string
+}
+
+func newPlainUpstream(network, addr string) *plainUpstream {
+	return &plainUpstream{network: network, addr: addr}
+}
+
+func (u *plainUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	c := &dns.Client{Net: u.network, Timeout: wait}
+	_msg, err := u.exchange(ctx, c, msg)
+	if err == nil && _msg.Truncated && u.network == "udp" {
+		// retry with tcp
+		c.Net = "tcp"
+		_msg, err = u.exchange(ctx, c, msg)
+	}
+	return _msg, err
+}
+
+// exchange exchanges msg on a new connection, which is closed once ctx is
+// canceled, as dns.Client only takes the deadline of ctx.
+func (u *plainUpstream) exchange(ctx context.Context, c *dns.Client, msg *dns.Msg) (*dns.Msg, error) {
+	conn, err := c.DialContext(ctx, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	_msg, _, err := c.ExchangeWithConnContext(ctx, msg, conn)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return _msg, err
+}
+
+func (u *plainUpstream) String() string {
+	return u.network + "://" + u.addr
+}
@@ -0,0 +1,175 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnsMessageType = "application/dns-message"
+
+	dohTemplateGET = "{?dns}" // URI template of the GET method, RFC 8484 4.1
+)
+
+// HTTPSUpstreamConfig is the config of a DNS-over-HTTPS (RFC 8484) upstream.
+type HTTPSUpstreamConfig struct {
+	// URL of the endpoint, like https://dns.example/dns-query
+	URL string
+
+	// http.MethodGet or http.MethodPost, POST by default
+	Method string
+
+	// CAs to verify the server, the system roots by default
+	RootCAs *x509.CertPool
+}
+
+// httpsUpstream is a DNS-over-HTTPS server, whose connections are
+// reused with HTTP/2.
+type httpsUpstream struct {
+	url      string
+	endpoint *url.URL // parsed url, whose query keeps the dns parameter of GET
+	method   string
+	client   *http.Client
+}
+
+// NewHTTPSUpstream creates a DNS-over-HTTPS upstream.
+func NewHTTPSUpstream(cfg *HTTPSUpstreamConfig) (Upstream, error) {
+	u := &httpsUpstream{url: cfg.URL, method: cfg.Method}
+	if strings.HasSuffix(u.url, dohTemplateGET) {
+		u.url = strings.TrimSuffix(u.url, dohTemplateGET)
+		u.method = http.MethodGet
+	}
+	if u.method == "" {
+		u.method = http.MethodPost
+	}
+	if u.method != http.MethodGet && u.method != http.MethodPost {
+		return nil, ErrInvalidUpstream
+	}
+	endpoint, err := url.Parse(u.url)
+	if err != nil {
+		return nil, err
+	}
+	u.endpoint = endpoint
+
+	u.client = &http.Client{
+		Timeout: wait,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         (&net.Dialer{Timeout: wait}).DialContext,
+			TLSClientConfig:     &tls.Config{RootCAs: cfg.RootCAs, MinVersion: tls.VersionTLS12},
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     dotIdleTimeout,
+		},
+	}
+	return u, nil
+}
+
+func (u *httpsUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	// use id 0 for the HTTP caches, RFC 8484 4.1
+	query := *msg
+	query.Id = 0
+	data, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var req *http.Request
+	if u.method == http.MethodGet {
+		endpoint := *u.endpoint
+		params := endpoint.Query()
+		params.Set("dns", base64.RawURLEncoding.EncodeToString(data))
+		endpoint.RawQuery = params.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(data))
+		if err == nil {
+			req.Header.Set("Content-Type", dnsMessageType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dnsMessageType)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrServerFailed
+	}
+
+	data, err = io.ReadAll(io.LimitReader(resp.Body, maxTCPMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	_msg := new(dns.Msg)
+	if err := _msg.Unpack(data); err != nil {
+		return nil, err
+	}
+	_msg.Id = msg.Id
+
+	if maxAge, ok := httpMaxAge(resp.Header); ok {
+		capTTL(_msg, maxAge)
+	}
+	return _msg, nil
+}
+
+// httpMaxAge gets the remaining freshness lifetime of the HTTP response,
+// which is the max-age of Cache-Control minus Age.
+func httpMaxAge(h http.Header) (uint32, bool) {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		maxAge, err := strconv.ParseUint(strings.TrimPrefix(directive, "max-age="), 10, 32)
+		if err != nil {
+			return 0, false
+		}
+		age, _ := strconv.ParseUint(h.Get("Age"), 10, 32)
+		if age > maxAge {
+			return 0, true
+		}
+		return uint32(maxAge - age), true
+	}
+	return 0, false
+}
+
+// capTTL caps the ttl of the msg's RRs, except the OPT RR.
+func capTTL(msg *dns.Msg, ttl uint32) {
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			h := rr.Header()
+			if h.Rrtype != dns.TypeOPT && h.Ttl > ttl {
+				h.Ttl = ttl
+			}
+		}
+	}
+}
+
+// Close closes the idle connections.
+func (u *httpsUpstream) Close() error {
+	u.client.CloseIdleConnections()
+	return nil
+}
+
+func (u *httpsUpstream) String() string {
+	if u.method == http.MethodGet {
+		return u.url + dohTemplateGET
+	}
+	return u.url
+}
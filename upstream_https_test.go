@@ -0,0 +1,89 @@
+package dnsproxy
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newTestDoHServer(t *testing.T) (*httptest.Server, *x509.CertPool) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dns-query" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.ProtoMajor != 2 {
+			t.Errorf("expected HTTP/2, got %s", r.Proto)
+		}
+		var data []byte
+		if r.Method == http.MethodGet {
+			data, _ = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		} else {
+			data, _ = io.ReadAll(r.Body)
+		}
+		q := new(dns.Msg)
+		if err := q.Unpack(data); err != nil || q.Id != 0 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		msg := new(dns.Msg).SetReply(q)
+		rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN A 192.0.2.80")
+		msg.Answer = append(msg.Answer, rr)
+		data, _ = msg.Pack()
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Write(data)
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	return ts, pool
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	ts, pool := newTestDoHServer(t)
+
+	for _, tt := range []struct {
+		path, method string
+	}{
+		{"/dns-query", http.MethodGet},
+		{"/dns-query?key=value", http.MethodGet}, // the dns parameter is added
+		{"/dns-query", http.MethodPost},
+	} {
+		method := tt.method
+		u, err := NewHTTPSUpstream(&HTTPSUpstreamConfig{URL: ts.URL + tt.path, Method: method, RootCAs: pool})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+		r, err := u.Exchange(context.Background(), m)
+		if err != nil {
+			t.Fatalf("failed to exchange with %s: %v", method, err)
+		}
+		if r.Id != m.Id || len(r.Answer) != 1 || r.Answer[0].Header().Ttl != 10 {
+			t.Errorf("unexpected response with %s: %v", method, r)
+		}
+	}
+}
+
+func TestHTTPSUpstreamFallback(t *testing.T) {
+	ts, pool := newTestDoHServer(t)
+	bad, _ := NewHTTPSUpstream(&HTTPSUpstreamConfig{URL: ts.URL + "/not-found", RootCAs: pool})
+	good, _ := NewHTTPSUpstream(&HTTPSUpstreamConfig{URL: ts.URL + "/dns-query", RootCAs: pool})
+
+	g, _ := newUpstreamGroup(StrategySequential, []Upstream{bad, good}, nil)
+	r := newResolver(context.Background(), g).(*recursiveResolver)
+	m := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+	if _, err := r.resolver.resolve(m); err != nil {
+		t.Errorf("failed to fall back to the next endpoint: %v", err)
+	}
+}
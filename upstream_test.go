@@ -0,0 +1,69 @@
+package dnsproxy
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseUpstream(t *testing.T) {
+	cases := []struct {
+		spec, want string
+	}{
+		{"8.8.8.8", "udp://8.8.8.8:53"},
+		{"2001:db8::1", "udp://[2001:db8::1]:53"},
+		{"udp://1.1.1.1:5353", "udp://1.1.1.1:5353"},
+		{"tcp://[2001:db8::1]", "tcp://[2001:db8::1]:53"},
+		{"tls://dns.example:853", "tls://dns.example:853"},
+		{"tls://dns.example", "tls://dns.example:853"},
+		{"https://dns.example/dns-query", "https://dns.example/dns-query"},
+		{"https://dns.example/dns-query{?dns}", "https://dns.example/dns-query{?dns}"},
+	}
+	for _, c := range cases {
+		u, err := ParseUpstream(c.spec)
+		if err != nil {
+			t.Errorf("failed to parse %s: %v", c.spec, err)
+			continue
+		}
+		if s := u.(interface{ String() string }).String(); s != c.want {
+			t.Errorf("parsed %s as %s, expected %s", c.spec, s, c.want)
+		}
+	}
+
+	for _, spec := range []string{"quic://dns.example", "udp://"} {
+		if _, err := ParseUpstream(spec); !errors.Is(err, ErrInvalidUpstream) {
+			t.Errorf("parsed invalid spec %s, err: %v", spec, err)
+		}
+	}
+}
+
+func TestParseUpstreamPin(t *testing.T) {
+	// find a SPKI whose pin has both '+' and '/' of standard base64
+	cert := &x509.Certificate{RawSubjectPublicKeyInfo: make([]byte, 32)}
+	for {
+		rand.Read(cert.RawSubjectPublicKeyInfo)
+		if pin := spkiHash(cert); strings.Contains(pin, "+") && strings.Contains(pin, "/") {
+			break
+		}
+	}
+
+	pin := spkiHash(cert)
+	for _, spec := range []string{
+		"tls://dns.example?pin=" + pin,
+		"tls://dns.example?sni=dns.example&pin=" + url.QueryEscape(pin),
+	} {
+		u, err := ParseUpstream(spec)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", spec, err)
+		}
+		verify := u.(*tlsUpstream).tlsConfig.VerifyConnection
+		cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		if err := verify(cs); err != nil {
+			t.Errorf("pin of %s mismatched: %v", spec, err)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package dnsproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const dotIdleTimeout = time.Second * 30 // close the idle upstream connection
+
+// TLSUpstreamConfig is the config of a DNS-over-TLS (RFC 7858) upstream.
+type TLSUpstreamConfig struct {
+	// address of the server, host:port
+	Addr string
+
+	// server name for SNI and certificate verification,
+	// the host of Addr by default
+	ServerName string
+
+	// base64 encoded SHA-256 hashes of the server's SubjectPublicKeyInfo,
+	// one of which must match a certificate of the server's chain
+	SPKIPins []string
+
+	// PEM encoded CA bundle to verify the server,
+	// the system roots by default
+	CAFile  string
+	RootCAs *x509.CertPool
+}
+
+// tlsUpstream is a DNS-over-TLS server, which keeps a persistent
+// connection and pipelines the queries on it.
+type tlsUpstream struct {
+	addr      string
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	conn *dotConn
+}
+
+// NewTLSUpstream creates a DNS-over-TLS upstream.
+func NewTLSUpstream(cfg *TLSUpstreamConfig) (Upstream, error) {
+	host, _, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		ServerName: cfg.ServerName,
+		RootCAs:    cfg.RootCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	if tlsConfig.RootCAs == nil && cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, ErrInvalidCA
+		}
+	}
+	if len(cfg.SPKIPins) != 0 {
+		pins := make(map[string]bool, len(cfg.SPKIPins))
+		for _, pin := range cfg.SPKIPins {
+			pins[pin] = true
+		}
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				if pins[spkiHash(cert)] {
+					return nil
+				}
+			}
+			return ErrPinMismatch
+		}
+	}
+	return &tlsUpstream{addr: cfg.Addr, tlsConfig: tlsConfig}, nil
+}
+
+// spkiHash gets the base64 encoded SHA-256 hash of the cert's
+// SubjectPublicKeyInfo, as RFC 7469.
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (u *tlsUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	c, err := u.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_msg, err := c.exchange(ctx, msg)
+	if err == errConnBroken {
+		// the persistent connection may be closed by the server, redial
+		if c, err = u.getConn(ctx); err != nil {
+			return nil, err
+		}
+		_msg, err = c.exchange(ctx, msg)
+	}
+	return _msg, err
+}
+
+func (u *tlsUpstream) getConn(ctx context.Context) (*dotConn, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn != nil && !u.conn.isClosed() {
+		return u.conn, nil
+	}
+
+	d := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: wait},
+		Config:    u.tlsConfig,
+	}
+	conn, err := d.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	u.conn = newDotConn(conn, dotIdleTimeout)
+	return u.conn, nil
+}
+
+// Close closes the persistent connection.
+func (u *tlsUpstream) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn != nil {
+		u.conn.close()
+		u.conn = nil
+	}
+	return nil
+}
+
+func (u *tlsUpstream) String() string {
+	return "tls://" + u.addr
+}
+
+var errConnBroken = errors.New("connection broken")
+
+// dotConn is a connection to a DNS-over-TLS server, the queries on it
+// are distinguished by the message id, so the responses may come out
+// of order.
+type dotConn struct {
+	conn net.Conn
+	wmu  sync.Mutex
+	idle time.Duration // closed if idle for it
+
+	mu      sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	done    chan struct{}
+}
+
+func newDotConn(conn net.Conn, idle time.Duration) *dotConn {
+	c := &dotConn{
+		conn:    conn,
+		idle:    idle,
+		pending: make(map[uint16]chan *dns.Msg),
+		done:    make(chan struct{}),
+	}
+	go c.read()
+	return c
+}
+
+func (c *dotConn) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	id, ch, err := c.register()
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(id)
+
+	// query with the id unique on the connection, and restore it after
+	query := *msg
+	query.Id = id
+	data, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxTCPMsgSize {
+		return nil, ErrHugePacket
+	}
+
+	c.wmu.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(wait))
+	_, err = c.conn.Write(lengthPrefixed(data))
+	c.wmu.Unlock()
+	if err != nil {
+		c.close()
+		return nil, errConnBroken
+	}
+
+	select {
+	case _msg := <-ch:
+		_msg.Id = msg.Id
+		return _msg, nil
+	case <-c.done:
+		return nil, errConnBroken
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *dotConn) register() (uint16, chan *dns.Msg, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isClosed() {
+		return 0, nil, errConnBroken
+	}
+	id := dns.Id()
+	for c.pending[id] != nil {
+		id = dns.Id()
+	}
+	ch := make(chan *dns.Msg, 1)
+	c.pending[id] = ch
+	return id, ch, nil
+}
+
+func (c *dotConn) unregister(id uint16) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+func (c *dotConn) busy() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending) > 0
+}
+
+func (c *dotConn) read() {
+	defer c.close()
+
+	header := make([]byte, 2)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.idle))
+		n, err := io.ReadFull(c.conn, header)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && c.busy() {
+			if n == 0 {
+				continue
+			}
+			// finish reading the partial length, not to lose the framing
+			c.conn.SetReadDeadline(time.Now().Add(c.idle))
+			_, err = io.ReadFull(c.conn, header[n:])
+		}
+		if err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(c.conn, data); err != nil {
+			return
+		}
+
+		msg := new(dns.Msg)
+		if err := msg.Unpack(data); err != nil {
+			continue
+		}
+		c.mu.Lock()
+		ch := c.pending[msg.Id]
+		delete(c.pending, msg.Id)
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- msg
+		}
+	}
+}
+
+func (c *dotConn) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *dotConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.isClosed() {
+		close(c.done)
+		c.conn.Close()
+	}
+}
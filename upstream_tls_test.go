@@ -0,0 +1,157 @@
+package dnsproxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newTestCA creates a self-signed CA, and a certificate for the names
+// signed by the CA.
+func newTestCA(t *testing.T, names ...string) (*x509.CertPool, tls.Certificate) {
+	_, pool, cert := newTestCACert(t, names...)
+	return pool, cert
+}
+
+func newTestCACert(t *testing.T, names ...string) (*x509.Certificate, *x509.CertPool, tls.Certificate) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dnsproxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return ca, pool, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestTLSUpstream(t *testing.T) {
+	pool, cert := newTestCA(t, "dns.example")
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	clients := make(map[string]bool)
+	srv := &dns.Server{Listener: l, Net: "tcp-tls", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		clients[w.RemoteAddr().String()] = true
+		mu.Unlock()
+		answerA("192.0.2.53")(w, r)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	u, err := NewTLSUpstream(&TLSUpstreamConfig{
+		Addr:       l.Addr().String(),
+		ServerName: "dns.example",
+		SPKIPins:   []string{spkiHash(cert.Leaf)},
+		RootCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.(*tlsUpstream).Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+			r, err := u.Exchange(context.Background(), m)
+			if err != nil {
+				t.Errorf("failed to exchange: %v", err)
+				return
+			}
+			if r.Id != m.Id || len(r.Answer) != 1 {
+				t.Errorf("unexpected response: %v", r)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(clients) != 1 {
+		t.Errorf("queries are not pipelined on one connection, got %d connections", len(clients))
+	}
+
+	bad, _ := NewTLSUpstream(&TLSUpstreamConfig{
+		Addr:       l.Addr().String(),
+		ServerName: "dns.example",
+		SPKIPins:   []string{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="},
+		RootCAs:    pool,
+	})
+	m := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+	if _, err := bad.Exchange(context.Background(), m); !errors.Is(err, ErrPinMismatch) {
+		t.Errorf("expected pin mismatch, got %v", err)
+	}
+}
+
+func TestDotConnPartialLength(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := newDotConn(client, 100*time.Millisecond)
+	defer c.close()
+
+	go func() {
+		q, err := (&dns.Conn{Conn: server}).ReadMsg()
+		if err != nil {
+			return
+		}
+		data, _ := new(dns.Msg).SetReply(q).Pack()
+		buf := lengthPrefixed(data)
+		// the read of the length times out after its first byte
+		server.Write(buf[:1])
+		time.Sleep(150 * time.Millisecond)
+		server.Write(buf[1:])
+	}()
+
+	m := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	r, err := c.exchange(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != m.Id {
+		t.Errorf("unexpected reply: %v", r)
+	}
+}
@@ -1,7 +1,10 @@
 package dnsproxy
 
 import (
+	"context"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	"github.com/Asphaltt/hqu"
 	"github.com/miekg/dns"
@@ -9,107 +12,140 @@ import (
 
 type userPacket struct {
 	data []byte
-	addr *net.UDPAddr
+	addr net.Addr    // the client's address
+	conn *tcpConn    // not nil if the query comes from tcp
+	resp chan []byte // not nil if the query comes from https
+	size int         // max size of the response over udp
 }
 
-type worker struct {
-	server *server
+func (p *userPacket) isUDP() bool {
+	return p.conn == nil && p.resp == nil
+}
+
+// done marks the packet has been responded or dropped.
+func (p *userPacket) done() {
+	if p.conn != nil {
+		p.conn.release()
+	}
+	if p.resp != nil {
+		close(p.resp)
+	}
+}
 
-	withCache bool
+type worker struct {
+	server *Server
 
 	recvChan chan *userPacket
 	sendChan chan *userPacket
-
-	resolver iresolver
+	quit     chan struct{}
 }
 
-func newWorker(s *server) *worker {
-	w := &worker{
-		server:    s,
-		withCache: s.config.WithCache,
-		recvChan:  s.recvChan,
-		sendChan:  s.sendChan,
+func newWorker(s *Server) *worker {
+	return &worker{
+		server:   s,
+		recvChan: s.recvChan,
+		sendChan: s.sendChan,
+		quit:     make(chan struct{}),
 	}
-	w.resolver = newResolver(w, s.config.UpServers)
-	go w.run()
-	return w
 }
 
 func (w *worker) run() {
 	for {
-		upack, ok := <-w.recvChan
+		var upack *userPacket
+		var ok bool
+		select {
+		case upack, ok = <-w.recvChan:
+		case <-w.quit:
+			return
+		}
 		if !ok {
 			return
 		}
+		if w.server.isAborted() {
+			atomic.AddInt64(&w.server.dropped, 1)
+			upack.done()
+			continue
+		}
 
 		msg := new(dns.Msg)
 		err := msg.Unpack(upack.data)
 		if err != nil {
+			upack.done()
 			continue
 		}
 
 		if len(msg.Question) == 0 {
+			upack.done()
 			continue
 		}
+		upack.size = udpSize(msg, w.server.config.UDPMaxSize)
 
-		// cached resolve
-		if w.withCache {
-			_msg, ok := w.resolveCache(msg)
-			if ok {
-				w.send(upack, _msg)
-				continue
-			}
-		}
+		w.serve(upack, msg)
+	}
+}
 
-		// normally resolve
-		_msg, err := w.resolver.resolve(msg)
-		if err == nil {
-			w.send(upack, _msg)
-			continue
-		}
+// serve passes the query to the server's handler chain.
+func (w *worker) serve(upack *userPacket, msg *dns.Msg) {
+	ctx, cancel := context.WithTimeout(w.server.ctx, timeout)
+	defer cancel()
 
-		w.send(upack, msg)
+	pw := &packetWriter{worker: w, pkt: upack}
+	w.server.proxy.serve(ctx, pw, msg)
+	if !pw.written {
+		upack.done()
 	}
 }
 
-func (w *worker) send(pkt *userPacket, msg *dns.Msg) {
-	msg.Response = true
-	msg.Rcode = dns.RcodeSuccess
-	if len(msg.Answer) == 0 {
-		msg.Rcode = dns.RcodeNameError
-	}
-	msg.RecursionAvailable = true
+func (w *worker) send(pkt *userPacket, msg *dns.Msg) error {
+	setResponse(msg, pkt.isUDP(), pkt.size)
 	var err error
 	if pkt.data, err = msg.Pack(); err != nil {
-		return
+		pkt.done()
+		return err
+	}
+	if pkt.conn != nil {
+		pkt.conn.send(pkt)
+		return nil
 	}
 	w.sendChan <- pkt
+	return nil
 }
 
-func (w *worker) resolveCache(msg *dns.Msg) (*dns.Msg, bool) {
-	r, ok := w.server.cache.Get(getQuetion(msg))
-	if !ok {
-		return msg, false
-	}
-	msg.Answer = make([]dns.RR, len(r.Msg.Answer))
-	copy(msg.Answer, r.Msg.Answer)
-	return msg, len(msg.Answer) > 0
+func (w *worker) close() {
+	close(w.quit)
 }
 
-func (w *worker) close() {
-	w.resolver.close()
+// packetWriter writes the response to the user's packet,
+// only the first response is written.
+type packetWriter struct {
+	worker  *worker
+	pkt     *userPacket
+	written bool
+}
+
+func (pw *packetWriter) RemoteAddr() net.Addr {
+	return pw.pkt.addr
+}
+
+func (pw *packetWriter) WriteMsg(msg *dns.Msg) error {
+	if pw.written {
+		return ErrWritten
+	}
+	pw.written = true
+	return pw.worker.send(pw.pkt, msg)
 }
 
 // -- worker pool
 
 type workerPool struct {
-	server  *server
+	server  *Server
 	workers *hqu.Stack
+	wg      sync.WaitGroup
 
 	min, max int
 }
 
-func newWorkerPool(s *server) *workerPool {
+func newWorkerPool(s *Server) *workerPool {
 	p := &workerPool{
 		server:  s,
 		workers: &hqu.Stack{},
@@ -117,14 +153,24 @@ func newWorkerPool(s *server) *workerPool {
 		max:     s.config.WorkerPoolMax,
 	}
 	for i := 0; i < s.config.WorkerPoolMin; i++ {
-		p.workers.Push(newWorker(s))
+		p.start()
 	}
 	return p
 }
 
+func (wp *workerPool) start() {
+	w := newWorker(wp.server)
+	wp.workers.Push(w)
+	wp.wg.Add(1)
+	go func() {
+		defer wp.wg.Done()
+		w.run()
+	}()
+}
+
 func (wp *workerPool) openOne() {
 	if wp.size() < wp.max {
-		wp.workers.Push(newWorker(wp.server))
+		wp.start()
 	}
 }
 
@@ -141,11 +187,8 @@ func (wp *workerPool) size() int {
 	return wp.workers.Size()
 }
 
-func (wp *workerPool) close() {
-	wp.workers.Range(func(v interface{}) bool {
-		if v != nil {
-			v.(*worker).close()
-		}
-		return true
-	})
+// wait waits for all the workers quitting,
+// which quit after draining the closed recvChan.
+func (wp *workerPool) wait() {
+	wp.wg.Wait()
 }